@@ -0,0 +1,253 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	acceptEncoding  = "Accept-Encoding"
+	contentEncoding = "Content-Encoding"
+	vary            = "Vary"
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// minCompressSize is the smallest fully buffered body worth compressing.
+const minCompressSize = 1024
+
+// maxCompressBufferSize is the largest compressed body buffer kept for reuse.
+const maxCompressBufferSize = 64 * 1024
+
+// compressor is implemented by *gzip.Writer and *zlib.Writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var (
+	gzipWriterPool = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	zlibWriterPool = sync.Pool{New: func() interface{} {
+		return zlib.NewWriter(nil)
+	}}
+	compressBufferPool = sync.Pool{New: func() interface{} {
+		return new(bytes.Buffer)
+	}}
+)
+
+func newCompressor(encoding string, w io.Writer) compressor {
+	var zw compressor
+	if encoding == encodingGzip {
+		zw = gzipWriterPool.Get().(*gzip.Writer)
+	} else {
+		zw = zlibWriterPool.Get().(*zlib.Writer)
+	}
+	zw.Reset(w)
+	return zw
+}
+
+func freeCompressor(encoding string, zw compressor) {
+	zw.Reset(nil)
+	if encoding == encodingGzip {
+		gzipWriterPool.Put(zw)
+	} else {
+		zlibWriterPool.Put(zw)
+	}
+}
+
+func freeCompressBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxCompressBufferSize {
+		return
+	}
+	b.Reset()
+	compressBufferPool.Put(b)
+}
+
+// chunkSink is the writer under a compressor, which frames the compressed
+// bytes as chunks.
+type chunkSink chunkWriter
+
+func (s *chunkSink) Write(p []byte) (n int, err error) {
+	return (*chunkWriter)(s).writeChunk(p)
+}
+
+// SetCompression sets whether the body is compressed with gzip or deflate
+// when the request's Accept-Encoding header allows it. Small bodies, HEAD
+// requests, compressed content types and responses with a Content-Encoding,
+// a Content-Length or a Transfer-Encoding set by the handler are sent
+// as they are. It has no effect once the header has been written to the
+// connection.
+func (w *Response) SetCompression(compress bool) {
+	if w.cw.wroteHeader {
+		return
+	}
+	w.compress = compress
+}
+
+// startCompression decides whether to compress the body when the header
+// is written. If the handler has finished, the whole body is p and no
+// trailers are declared, it is compressed at once into a pooled buffer so
+// that the response keeps its Content-Length; otherwise the body is
+// compressed as it is streamed.
+func (cw *chunkWriter) startCompression(p []byte, isHEAD, trailers bool) {
+	w := cw.res
+	if !bodyAllowedForStatus(w.status) || w.isTunnel() || len(w.setHeader.contentLength) > 0 || len(w.setHeader.transferEncoding) > 0 {
+		return
+	}
+	if w.handlerHeader.Get(contentEncoding) != emptyString {
+		return
+	}
+	// The representation depends on Accept-Encoding even when it ends
+	// up not being compressed.
+	addVary(w.handlerHeader, acceptEncoding)
+	if isHEAD {
+		return
+	}
+	ct := w.handlerHeader.Get(contentType)
+	if ct == emptyString && !w.options.DisableSniff && len(p) > 0 {
+		ct = http.DetectContentType(p)
+		w.setHeader.contentType = ct
+	}
+	if !compressible(ct) {
+		return
+	}
+	buffered := w.handlerDone.isSet() && !w.noCache
+	if buffered && len(p) < minCompressSize {
+		return
+	}
+	encoding := negotiateEncoding(w.req.Header.Get(acceptEncoding))
+	if encoding == emptyString {
+		return
+	}
+	if buffered && !trailers {
+		zbuf := compressBufferPool.Get().(*bytes.Buffer)
+		zw := newCompressor(encoding, zbuf)
+		zw.Write(p)
+		zw.Close()
+		freeCompressor(encoding, zw)
+		if zbuf.Len() >= len(p) {
+			freeCompressBuffer(zbuf)
+			return
+		}
+		cw.zbuf = zbuf
+		w.setContentLength(zbuf.Len())
+	} else {
+		cw.zw = newCompressor(encoding, (*chunkSink)(cw))
+		cw.encoding = encoding
+	}
+	w.handlerHeader.Set(contentEncoding, encoding)
+}
+
+// addVary adds the key to the Vary header unless it is listed already.
+func addVary(h http.Header, key string) {
+	lower := strings.ToLower(key)
+	for _, v := range h[vary] {
+		if v == "*" || hasToken(v, lower) {
+			return
+		}
+	}
+	h.Add(vary, key)
+}
+
+// incompressibleTypes lists the media types whose content is compressed
+// already.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"application/octet-stream",
+	"application/pdf",
+}
+
+// compressible reports whether a body of the content type is worth
+// compressing.
+func compressible(ct string) bool {
+	ct = strings.ToLower(ct)
+	if strings.HasPrefix(ct, "image/svg+xml") {
+		return true
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiateEncoding returns gzip or deflate, whichever the Accept-Encoding
+// header value prefers, or an empty string if it accepts neither.
+// gzip wins a tie.
+func negotiateEncoding(accept string) string {
+	if accept == emptyString {
+		return emptyString
+	}
+	gzipQ, deflateQ, anyQ := -1.0, -1.0, -1.0
+	foreachHeaderElement(accept, func(v string) {
+		coding, q := parseCoding(v)
+		switch {
+		case strings.EqualFold(coding, encodingGzip), strings.EqualFold(coding, "x-gzip"):
+			gzipQ = q
+		case strings.EqualFold(coding, encodingDeflate):
+			deflateQ = q
+		case coding == "*":
+			anyQ = q
+		}
+	})
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if deflateQ < 0 {
+		deflateQ = anyQ
+	}
+	if gzipQ <= 0 && deflateQ <= 0 {
+		return emptyString
+	}
+	if gzipQ >= deflateQ {
+		return encodingGzip
+	}
+	return encodingDeflate
+}
+
+// parseCoding parses an element of Accept-Encoding such as "gzip;q=0.8"
+// into its content coding and quality value.
+func parseCoding(v string) (coding string, q float64) {
+	q = 1
+	i := strings.IndexByte(v, ';')
+	if i < 0 {
+		return strings.TrimSpace(v), q
+	}
+	coding = strings.TrimSpace(v[:i])
+	for _, param := range strings.Split(v[i+1:], ";") {
+		param = strings.TrimSpace(param)
+		if len(param) < 2 || param[0] != 'q' && param[0] != 'Q' || param[1] != '=' {
+			continue
+		}
+		if f, err := strconv.ParseFloat(param[2:], 64); err == nil && f >= 0 && f <= 1 {
+			q = f
+		} else {
+			q = 0
+		}
+	}
+	return coding, q
+}
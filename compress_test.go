@@ -0,0 +1,190 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testCompression(method, url, accept string, encoding string, result string, t *testing.T) http.Header {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxConnsPerHost:    1,
+			DisableKeepAlives:  true,
+			DisableCompression: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != encoding {
+		t.Errorf("%s %s: Content-Encoding %q, want %q", accept, url, got, encoding)
+	}
+	var body io.Reader = resp.Body
+	switch encoding {
+	case "gzip":
+		if body, err = gzip.NewReader(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	case "deflate":
+		if body, err = zlib.NewReader(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, err := ioutil.ReadAll(body); err != nil {
+		t.Error(err)
+	} else if string(b) != result {
+		t.Errorf("%s %s: body length %d, want %d", accept, url, len(b), len(result))
+	}
+	return resp.Header
+}
+
+func TestCompression(t *testing.T) {
+	text := strings.Repeat("Hello World!\r\n", 128)
+	big := strings.Repeat(text, 32)
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(*Response).SetCompression(true)
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("Hello World!\r\n"))
+			return
+		case "/png":
+			w.Header().Set(contentType, "image/png")
+		case "/encoded":
+			w.Header().Set(contentEncoding, "br")
+		case "/length":
+			w.Header().Set(contentLength, strconv.Itoa(len(text)))
+		case "/stream":
+			w.Write([]byte(big))
+			return
+		case "/trailer":
+			w.Header().Set("Trailer", "X-Sum")
+			w.Write([]byte(text))
+			w.Header().Set("X-Sum", "abc")
+			return
+		}
+		w.Write([]byte(text))
+	}), t)
+	defer stop()
+	h := testCompression("GET", "http://"+addr+"/", "gzip", "gzip", text, t)
+	if h.Get("Vary") != "Accept-Encoding" {
+		t.Error(h.Get("Vary"))
+	}
+	if n, _ := strconv.Atoi(h.Get(contentLength)); n == 0 || n >= len(text) {
+		t.Error(h.Get(contentLength))
+	}
+	if h.Get(contentType) != defaultContentType {
+		t.Error(h.Get(contentType))
+	}
+	testCompression("GET", "http://"+addr+"/", "deflate, gzip;q=0.5", "deflate", text, t)
+	testCompression("GET", "http://"+addr+"/", "*", "gzip", text, t)
+	testCompression("GET", "http://"+addr+"/", "gzip;q=0, deflate;q=0", "", text, t)
+	testCompression("GET", "http://"+addr+"/", "", "", text, t)
+	if h := testCompression("GET", "http://"+addr+"/small", "gzip", "", "Hello World!\r\n", t); h.Get("Vary") != "Accept-Encoding" {
+		t.Error(h.Get("Vary"))
+	}
+	testCompression("GET", "http://"+addr+"/png", "gzip", "", text, t)
+	if h := testCompression("GET", "http://"+addr+"/encoded", "gzip", "br", text, t); h.Get("Vary") != "" {
+		t.Error(h.Get("Vary"))
+	}
+	testCompression("GET", "http://"+addr+"/length", "gzip", "", text, t)
+	testCompression("HEAD", "http://"+addr+"/", "gzip", "", "", t)
+	h = testCompression("GET", "http://"+addr+"/stream", "gzip", "gzip", big, t)
+	if h.Get(contentLength) != "" {
+		t.Error(h.Get(contentLength))
+	}
+	// A buffered body with trailers is compressed into chunks.
+	req, _ := http.NewRequest("GET", "http://"+addr+"/trailer", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("Content-Length %d Content-Encoding %q", resp.ContentLength, resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); string(b) != text {
+		t.Errorf("body length %d, want %d", len(b), len(text))
+	}
+	ioutil.ReadAll(resp.Body)
+	if resp.Trailer.Get("X-Sum") != "abc" {
+		t.Errorf("trailer %v", resp.Trailer)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		accept   string
+		encoding string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip; q=0.8, deflate;q=0.9", "deflate"},
+		{"gzip;q=0", ""},
+		{"*", "gzip"},
+		{"*;q=0.1, gzip;q=0", "deflate"},
+		{"br;q=1.0, *;q=0", ""},
+		{"gzip;q=bogus, deflate", "deflate"},
+	}
+	for _, c := range cases {
+		if got := negotiateEncoding(c.accept); got != c.encoding {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", c.accept, got, c.encoding)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	for _, ct := range []string{"text/html; charset=utf-8", "application/json", "image/svg+xml", ""} {
+		if !compressible(ct) {
+			t.Error(ct)
+		}
+	}
+	for _, ct := range []string{"image/png", "video/mp4", "application/zip", "application/gzip", "font/woff2"} {
+		if compressible(ct) {
+			t.Error(ct)
+		}
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	h := make(http.Header)
+	addVary(h, "Accept-Encoding")
+	addVary(h, "Accept-Encoding")
+	if len(h["Vary"]) != 1 {
+		t.Error(h["Vary"])
+	}
+	h = http.Header{"Vary": {"Origin, accept-encoding"}}
+	addVary(h, "Accept-Encoding")
+	if len(h["Vary"]) != 1 {
+		t.Error(h["Vary"])
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"net/http"
+	"net/textproto"
+	"time"
+)
+
+const (
+	ifMatch           = "If-Match"
+	ifNoneMatch       = "If-None-Match"
+	ifModifiedSince   = "If-Modified-Since"
+	ifUnmodifiedSince = "If-Unmodified-Since"
+)
+
+// condResult is the result of an HTTP request precondition check.
+// See https://tools.ietf.org/html/rfc7232 section 3.
+type condResult int
+
+const (
+	condNone condResult = iota
+	condTrue
+	condFalse
+)
+
+// checkPreconditions evaluates the request's preconditions against the
+// ETag and Last-Modified headers of a 2xx response, in the order of
+// RFC 7232, section 6. It returns 304 Not Modified, 412 Precondition
+// Failed, or 0 if the response is sent as it is.
+//
+// Only GET and HEAD responses are checked. The handler of another method
+// has performed it by the time the header is written, so it must evaluate
+// the preconditions itself, before changing anything.
+func (w *Response) checkPreconditions() int {
+	r := w.req
+	if w.status < 200 || w.status > 299 || r.Method != "GET" && r.Method != head {
+		return 0
+	}
+	if len(r.Header[ifMatch]) == 0 && len(r.Header[ifNoneMatch]) == 0 &&
+		len(r.Header[ifModifiedSince]) == 0 && len(r.Header[ifUnmodifiedSince]) == 0 {
+		return 0
+	}
+	et := w.handlerHeader.Get(eTag)
+	lm := w.handlerHeader.Get(lastModified)
+	ch := checkIfMatch(r, et)
+	if ch == condNone {
+		ch = checkIfUnmodifiedSince(r, lm)
+	}
+	if ch == condFalse {
+		return http.StatusPreconditionFailed
+	}
+	switch checkIfNoneMatch(r, et) {
+	case condFalse:
+		return http.StatusNotModified
+	case condNone:
+		if checkIfModifiedSince(r, lm) == condFalse {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// notModifiedHeaders are the representation headers removed from a 304
+// response. See RFC 7232, section 4.1.
+var notModifiedHeaders = []string{contentType, contentLength, contentEncoding, transferEncoding, contentRange}
+
+// preconditionFailed turns the response into a 304 or 412 response
+// without a body. It is called when the header is written, so the body
+// the handler writes is discarded.
+func (cw *chunkWriter) preconditionFailed(code int) {
+	w := cw.res
+	w.status = code
+	for _, key := range notModifiedHeaders {
+		w.handlerHeader.Del(key)
+	}
+	w.setHeader.contentType = emptyString
+	w.setHeader.transferEncoding = emptyString
+	w.setHeader.contentLength = emptyString
+	w.contentLength = -1
+	cw.chunking = false
+	cw.discard = true
+	if code == http.StatusNotModified {
+		if w.handlerHeader.Get(eTag) != emptyString {
+			w.handlerHeader.Del(lastModified)
+		}
+		return
+	}
+	w.setContentLength(0)
+}
+
+func checkIfMatch(r *http.Request, etag string) condResult {
+	im := r.Header.Get(ifMatch)
+	if im == emptyString {
+		return condNone
+	}
+	for {
+		im = textproto.TrimString(im)
+		if len(im) == 0 {
+			break
+		}
+		if im[0] == ',' {
+			im = im[1:]
+			continue
+		}
+		if im[0] == '*' {
+			return condTrue
+		}
+		e, remain := scanETag(im)
+		if e == emptyString {
+			break
+		}
+		if etagStrongMatch(e, etag) {
+			return condTrue
+		}
+		im = remain
+	}
+	return condFalse
+}
+
+func checkIfUnmodifiedSince(r *http.Request, modtime string) condResult {
+	ius := r.Header.Get(ifUnmodifiedSince)
+	if ius == emptyString || modtime == emptyString {
+		return condNone
+	}
+	t, err := http.ParseTime(ius)
+	if err != nil {
+		return condNone
+	}
+	m, err := http.ParseTime(modtime)
+	if err != nil {
+		return condNone
+	}
+	// The Last-Modified header truncates sub-second precision so
+	// the modtime needs to be truncated too.
+	if m.Truncate(time.Second).Before(t) || m.Truncate(time.Second).Equal(t) {
+		return condTrue
+	}
+	return condFalse
+}
+
+func checkIfNoneMatch(r *http.Request, etag string) condResult {
+	inm := r.Header.Get(ifNoneMatch)
+	if inm == emptyString {
+		return condNone
+	}
+	buf := inm
+	for {
+		buf = textproto.TrimString(buf)
+		if len(buf) == 0 {
+			break
+		}
+		if buf[0] == ',' {
+			buf = buf[1:]
+			continue
+		}
+		if buf[0] == '*' {
+			return condFalse
+		}
+		e, remain := scanETag(buf)
+		if e == emptyString {
+			break
+		}
+		if etagWeakMatch(e, etag) {
+			return condFalse
+		}
+		buf = remain
+	}
+	return condTrue
+}
+
+func checkIfModifiedSince(r *http.Request, modtime string) condResult {
+	if r.Method != "GET" && r.Method != head {
+		return condNone
+	}
+	ims := r.Header.Get(ifModifiedSince)
+	if ims == emptyString || modtime == emptyString {
+		return condNone
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return condNone
+	}
+	m, err := http.ParseTime(modtime)
+	if err != nil {
+		return condNone
+	}
+	if m.Before(t) || m.Equal(t) {
+		return condFalse
+	}
+	return condTrue
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConditional(t *testing.T) {
+	const modtime = "Mon, 02 Jan 2006 15:04:05 GMT"
+	const before = "Sun, 01 Jan 2006 15:04:05 GMT"
+	const after = "Tue, 03 Jan 2006 15:04:05 GMT"
+	small := "Hello World"
+	large := strings.Repeat("a", bufferBeforeChunkingSize*2)
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", modtime)
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/large":
+			w.Write([]byte(large))
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(small))
+		case "/update":
+			// The update is done, and the new version sent.
+			w.Header().Set("ETag", `"v2"`)
+			w.Write([]byte(small))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(small))
+		default:
+			w.Write([]byte(small))
+		}
+	}), t)
+	defer stop()
+	tests := []struct {
+		method string
+		path   string
+		key    string
+		value  string
+		code   int
+	}{
+		{"GET", "/", "", "", 200},
+		{"GET", "/", "If-None-Match", `"v1"`, 304},
+		{"GET", "/", "If-None-Match", `W/"v1"`, 304},
+		{"GET", "/", "If-None-Match", `"v0", "v1"`, 304},
+		{"GET", "/", "If-None-Match", "*", 304},
+		{"GET", "/", "If-None-Match", `"v2"`, 200},
+		{"HEAD", "/", "If-None-Match", `"v1"`, 304},
+		{"GET", "/large", "If-None-Match", `"v1"`, 304},
+		{"GET", "/created", "If-None-Match", `"v1"`, 304},
+		{"GET", "/missing", "If-None-Match", `"v1"`, 404},
+		{"GET", "/", "If-Modified-Since", modtime, 304},
+		{"GET", "/", "If-Modified-Since", after, 304},
+		{"GET", "/", "If-Modified-Since", before, 200},
+		{"GET", "/", "If-Match", `"v1"`, 200},
+		{"GET", "/", "If-Match", "*", 200},
+		{"GET", "/", "If-Match", `"v2"`, 412},
+		{"GET", "/", "If-Match", `W/"v1"`, 412},
+		{"GET", "/large", "If-Match", `"v2"`, 412},
+		{"HEAD", "/", "If-Match", `"v2"`, 412},
+		{"GET", "/", "If-Unmodified-Since", modtime, 200},
+		{"GET", "/", "If-Unmodified-Since", before, 412},
+		// The handler of an unsafe method has performed it already.
+		{"PUT", "/update", "If-Match", `"v1"`, 200},
+		{"PUT", "/update", "If-None-Match", "*", 200},
+		{"PUT", "/", "If-Match", `"v2"`, 200},
+		{"PUT", "/", "If-Unmodified-Since", before, 200},
+		{"POST", "/", "If-None-Match", `"v1"`, 200},
+		{"POST", "/update", "If-Match", `"v1"`, 200},
+		{"POST", "/", "If-Modified-Since", modtime, 200},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://"+addr+test.path, nil)
+		if test.key != "" {
+			req.Header.Set(test.key, test.value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.code {
+			t.Errorf("%s %s %s: %s: status %d, want %d", test.method, test.path, test.key, test.value, resp.StatusCode, test.code)
+			continue
+		}
+		switch test.code {
+		case http.StatusNotModified:
+			if len(body) > 0 || resp.Header.Get("Content-Type") != "" || resp.Header.Get("Content-Length") != "" || resp.Header.Get("Last-Modified") != "" {
+				t.Errorf("%s %s: unexpected representation %v %q", test.key, test.value, resp.Header, body)
+			}
+			if resp.Header.Get("ETag") != `"v1"` {
+				t.Errorf("%s %s: ETag %q", test.key, test.value, resp.Header.Get("ETag"))
+			}
+		case http.StatusPreconditionFailed:
+			if len(body) > 0 || resp.ContentLength != 0 {
+				t.Errorf("%s %s: unexpected body %d %q", test.key, test.value, resp.ContentLength, body)
+			}
+		default:
+			if test.method != "HEAD" && len(body) == 0 {
+				t.Errorf("%s %s: empty body", test.key, test.value)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testNetHTTP writes the raw request to an httptest.Server serving the
+// handler, and returns the raw response.
+func testNetHTTP(raw string, handler http.HandlerFunc, t *testing.T) string {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.Start()
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go io.WriteString(conn, raw)
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// normalizeResponse returns the raw response with its header lines
+// sorted and the Date dropped, since net/http writes the header in
+// another order. The status line and the body, framing included, are
+// kept as they are.
+func normalizeResponse(raw string) string {
+	i := strings.Index(raw, "\r\n\r\n")
+	if i < 0 {
+		return raw
+	}
+	lines := strings.Split(raw[:i], "\r\n")
+	var fields []string
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "Date: ") {
+			fields = append(fields, line)
+		}
+	}
+	sort.Strings(fields)
+	return lines[0] + "\r\n" + strings.Join(fields, "\r\n") + "\r\n\r\n" + raw[i+4:]
+}
+
+func TestFramingConformance(t *testing.T) {
+	const get = "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	const get10 = "GET / HTTP/1.0\r\nHost: localhost\r\n\r\n"
+	const headReq = "HEAD / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	const connect = "CONNECT localhost:443 HTTP/1.1\r\nHost: localhost:443\r\n\r\n"
+	hello := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World"))
+	}
+	stream := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello "))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("World"))
+	}
+	large := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 3000)))
+	}
+	tests := []struct {
+		name    string
+		raw     string
+		handler http.HandlerFunc
+	}{
+		{"buffered", get, hello},
+		{"empty", get, func(w http.ResponseWriter, r *http.Request) {}},
+		{"stream", get, stream},
+		{"large", get, large},
+		{"declared", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "11")
+			w.(http.Flusher).Flush()
+			w.Write([]byte("Hello World"))
+		}},
+		{"trailer", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "Checksum")
+			w.Write([]byte("Hello World"))
+			w.Header().Set("Checksum", "abc")
+		}},
+		{"length and chunked", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "11")
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Write([]byte("Hello World"))
+		}},
+		{"chunked", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Write([]byte("Hello World"))
+		}},
+		{"identity", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Transfer-Encoding", "identity")
+			w.Write([]byte("Hello World"))
+		}},
+		{"length and identity", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "11")
+			w.Header().Set("Transfer-Encoding", "identity")
+			w.Write([]byte("Hello World"))
+		}},
+		{"no content", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "11")
+			w.WriteHeader(http.StatusNoContent)
+		}},
+		{"no content chunked", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.WriteHeader(http.StatusNoContent)
+		}},
+		{"not modified", get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "11")
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Etag", `"abc"`)
+			w.WriteHeader(http.StatusNotModified)
+		}},
+		{"head", headReq, hello},
+		{"head empty", headReq, func(w http.ResponseWriter, r *http.Request) {}},
+		{"head large", headReq, large},
+		{"head declared", headReq, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "1000")
+		}},
+		{"head declared write", headReq, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "11")
+			w.Write([]byte("Hello World"))
+		}},
+		{"head stream", headReq, stream},
+		{"head chunked", headReq, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Write([]byte("Hello World"))
+		}},
+		{"head length and chunked", headReq, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "11")
+			w.Header().Set("Transfer-Encoding", "chunked")
+		}},
+		{"http/1.0", get10, hello},
+		{"http/1.0 stream", get10, stream},
+		{"http/1.0 chunked", get10, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Write([]byte("Hello World"))
+		}},
+		{"connect refused", connect, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := normalizeResponse(testNetHTTP(test.raw, test.handler, t))
+			got := normalizeResponse(testOptions(nil, test.raw, test.handler, t))
+			if got != want {
+				t.Errorf("got\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestConnectTunnel(t *testing.T) {
+	const connect = "CONNECT localhost:443 HTTP/1.1\r\nHost: localhost:443\r\n\r\n"
+	handlers := map[string]http.HandlerFunc{
+		"empty": func(w http.ResponseWriter, r *http.Request) {},
+		"tunnel": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "3")
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Write([]byte("Hello"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(" World"))
+		},
+	}
+	for name, handler := range handlers {
+		raw := testOptions(nil, connect, handler, t)
+		head := raw[:strings.Index(raw, "\r\n\r\n")+4]
+		if !strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n") {
+			t.Errorf("%s: %q", name, raw)
+		}
+		for _, key := range []string{"Content-Length", "Transfer-Encoding", "Connection"} {
+			if strings.Contains(head, key+": ") {
+				t.Errorf("%s: unexpected %s in %q", name, key, head)
+			}
+		}
+		if name == "tunnel" && raw[len(head):] != "Hello World" {
+			t.Errorf("%s: body %q", name, raw[len(head):])
+		}
+	}
+}
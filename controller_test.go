@@ -0,0 +1,103 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+package response
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+type testWrapper struct {
+	http.ResponseWriter
+}
+
+func (w testWrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestResponseController(t *testing.T) {
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(testWrapper{w})
+		switch r.URL.Path {
+		case "/duplex":
+			if err := rc.EnableFullDuplex(); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusOK)
+			if err := rc.Flush(); err != nil {
+				t.Error(err)
+			}
+			io.Copy(w, r.Body)
+		case "/read":
+			if err := rc.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+				t.Error(err)
+			}
+			if _, err := ioutil.ReadAll(r.Body); !os.IsTimeout(err) {
+				t.Errorf("read error %v, want timeout", err)
+			}
+			rc.SetReadDeadline(time.Time{})
+			w.Write([]byte("timeout"))
+		case "/write":
+			if err := rc.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+				t.Error(err)
+			}
+			w.Write([]byte("ok"))
+		case "/hijack":
+			conn, rw, err := rc.Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			if err := rc.SetWriteDeadline(time.Time{}); err != http.ErrHijacked {
+				t.Errorf("SetWriteDeadline returned %v", err)
+			}
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+			rw.Flush()
+		}
+	}), t)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	// The body is only sent once the header has arrived.
+	io.WriteString(conn, "POST /duplex HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "duplex")
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "duplex" {
+		t.Errorf("body %q", body)
+	}
+	for _, test := range []struct {
+		raw  string
+		body string
+	}{
+		{"POST /read HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\nConnection: close\r\n\r\n", "timeout"},
+		{"GET /write HTTP/1.1\r\nHost: localhost\r\n\r\n", "ok"},
+		{"GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\n", "hijacked"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, body := testRawRequest(bufio.NewReader(conn), conn, test.raw, "GET", t); body != test.body {
+			t.Errorf("body %q, want %q", body, test.body)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const eTag = "Etag"
+
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming ETag is returned. Otherwise,
+// it returns "", "".
+func scanETag(s string) (etag string, remain string) {
+	s = textproto.TrimString(s)
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return emptyString, emptyString
+	}
+	// ETag is either W/"text" or "text".
+	// See RFC 7232 2.3.
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		// Character values allowed in ETags.
+		case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		default:
+			return emptyString, emptyString
+		}
+	}
+	return emptyString, emptyString
+}
+
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+// Assumes a and b are valid ETags.
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != emptyString && a[0] == '"'
+}
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison.
+// Assumes a and b are valid ETags.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// SetETag sets whether a strong ETag is generated from the body when the
+// handler finishes with the whole body in the buffer and a 200 status, and
+// sets no ETag itself. The ETag is weak if the body is then compressed.
+// Conditional requests are evaluated against it, so a matching
+// If-None-Match is answered with 304 Not Modified. Streamed and chunked
+// responses, and responses to HEAD requests, whose body is not written,
+// are sent without an ETag. It has no effect once the header has been
+// written to the connection.
+func (w *Response) SetETag(etag bool) {
+	if w.cw.wroteHeader {
+		return
+	}
+	w.etag = etag
+}
+
+// generateETag sets the ETag header to the length and the 64-bit FNV-1a
+// hash of p, the fully buffered body, and reports whether it did.
+func (cw *chunkWriter) generateETag(p []byte) bool {
+	w := cw.res
+	if w.status != http.StatusOK || !w.handlerDone.isSet() || w.noCache || w.req.Method == head {
+		return false
+	}
+	if w.handlerHeader.Get(eTag) != emptyString {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write(p)
+	var buf [36]byte
+	b := append(buf[:0], '"')
+	b = strconv.AppendUint(b, uint64(len(p)), 16)
+	b = append(b, '-')
+	b = strconv.AppendUint(b, h.Sum64(), 16)
+	b = append(b, '"')
+	w.handlerHeader.Set(eTag, string(b))
+	return true
+}
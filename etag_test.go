@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	text := strings.Repeat("Hello World!\r\n", 100)
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := w.(*Response)
+		res.SetETag(r.URL.Path != "/off")
+		switch r.URL.Path {
+		case "/gzip":
+			res.SetCompression(true)
+		case "/set":
+			w.Header().Set("ETag", `"v1"`)
+		case "/stream":
+			w.Write([]byte(strings.Repeat(text, 10)))
+			return
+		case "/flush":
+			w.Write([]byte(text))
+			res.Flush()
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write([]byte(text))
+	}), t)
+	defer stop()
+	do := func(method, path, inm string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, "http://"+addr+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+	get := func(path, inm string) (*http.Response, string) {
+		return do("GET", path, inm)
+	}
+	resp, body := get("/", "")
+	etag := resp.Header.Get("ETag")
+	if e, _ := scanETag(etag); e != etag || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("ETag %q", etag)
+	}
+	if body != text {
+		t.Errorf("body %q", body)
+	}
+	if resp, _ := get("/", ""); resp.Header.Get("ETag") != etag {
+		t.Errorf("ETag %q, want %q", resp.Header.Get("ETag"), etag)
+	}
+	if resp, body := get("/", etag); resp.StatusCode != http.StatusNotModified || body != "" || resp.Header.Get("ETag") != etag {
+		t.Errorf("status %d ETag %q body %q", resp.StatusCode, resp.Header.Get("ETag"), body)
+	}
+	// A HEAD response has no body to hash, so it gets no ETag rather
+	// than one differing from the GET's.
+	if resp, _ := do("HEAD", "/", ""); resp.Header.Get("ETag") != "" {
+		t.Errorf("HEAD: ETag %q", resp.Header.Get("ETag"))
+	}
+	if resp, _ := do("HEAD", "/", etag); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != "" {
+		t.Errorf("HEAD: status %d ETag %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp, _ := get("/", `"0-0"`); resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+	resp, _ = get("/gzip", "")
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("ETag") != "W/"+etag {
+		t.Errorf("Content-Encoding %q ETag %q", resp.Header.Get("Content-Encoding"), resp.Header.Get("ETag"))
+	}
+	if resp, _ := get("/gzip", "W/"+etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+	if resp, _ := get("/set", ""); resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("ETag %q", resp.Header.Get("ETag"))
+	}
+	for _, path := range []string{"/off", "/stream", "/flush", "/created"} {
+		if resp, _ := get(path, ""); resp.Header.Get("ETag") != "" {
+			t.Errorf("%s: ETag %q", path, resp.Header.Get("ETag"))
+		}
+	}
+}
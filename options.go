@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// VersionPolicy selects the HTTP version written in the status line.
+type VersionPolicy int
+
+const (
+	// VersionMatch replies HTTP/1.0 to HTTP/1.0 requests and HTTP/1.1
+	// to the others.
+	VersionMatch VersionPolicy = iota
+	// VersionHTTP11 always replies HTTP/1.1, even to HTTP/1.0
+	// requests. The body is still framed for the version of the
+	// request.
+	VersionHTTP11
+)
+
+// Options configures the responses created by NewResponseWithOptions.
+// The zero value is the configuration of NewResponse.
+//
+// The same Options may be shared by any number of responses, and must
+// not be modified while they are in use.
+type Options struct {
+	// BufferSize is the size of the buffer holding the body until the
+	// handler finishes, so that a small body is sent with a
+	// Content-Length instead of chunked. Zero means 2048 bytes.
+	BufferSize int
+
+	// DisableSniff stops the Content-Type from being detected from the
+	// body when the handler doesn't set one.
+	DisableSniff bool
+
+	// DisableDate stops the Date header from being sent, unless the
+	// handler sets one.
+	DisableDate bool
+
+	// Server is the value of the Server header, unless the handler
+	// sets one. Empty means no Server header.
+	Server string
+
+	// MaxHeaderBytes is the maximum number of bytes of the request
+	// line and header that are read. Zero means
+	// http.DefaultMaxHeaderBytes. A Response is created once the
+	// request has been read, so it is enforced by the code that reads
+	// the request.
+	MaxHeaderBytes int
+
+	// WriteTimeout is the maximum duration before timing out writes of
+	// the response, starting when the response is created. Zero means
+	// no timeout.
+	WriteTimeout time.Duration
+
+	// Compression compresses the body with gzip or deflate when the
+	// request's Accept-Encoding header allows it. See SetCompression.
+	Compression bool
+
+	// ETag generates an ETag for fully buffered bodies. See SetETag.
+	ETag bool
+
+	// Vectored sends the header, the framing and the body with writev.
+	// See SetVectored.
+	Vectored bool
+
+	// Version selects the HTTP version written in the status line.
+	Version VersionPolicy
+
+	// HeaderPolicy selects what is done with a header field that is not
+	// valid. The default replaces the control bytes of its values.
+	HeaderPolicy HeaderPolicy
+
+	// ConnState specifies an optional callback function that is
+	// called when a client connection changes state, with the same
+	// semantics as http.Server.ConnState. NewResponseWithOptions
+	// reports StateActive, FinishRequest StateIdle or StateClosed, and
+	// Hijack StateHijacked; a Server reports StateNew and StateClosed
+	// as well.
+	ConnState func(net.Conn, http.ConnState)
+
+	// ErrorLog specifies an optional logger for the panics recovered by
+	// Serve. If nil, logging is done via the log package's standard
+	// logger.
+	ErrorLog Logger
+}
+
+// Logger is implemented by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+var defaultOptions = &Options{}
+
+func (o *Options) bufferSize() int {
+	if o.BufferSize > 0 {
+		return o.BufferSize
+	}
+	return bufferBeforeChunkingSize
+}
+
+func (o *Options) logf(format string, v ...interface{}) {
+	if o.ErrorLog != nil {
+		o.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+func (o *Options) maxHeaderBytes() int {
+	if o.MaxHeaderBytes > 0 {
+		return o.MaxHeaderBytes
+	}
+	return http.DefaultMaxHeaderBytes
+}
+
+// NewResponseWithOptions returns a new response configured by opts.
+// A nil opts is the same as NewResponse.
+func NewResponseWithOptions(req *http.Request, conn net.Conn, rw *bufio.ReadWriter, opts *Options) *Response {
+	if opts == nil {
+		opts = defaultOptions
+	}
+	return newResponseWithOptions(req, conn, rw, opts, nil)
+}
+
+func newResponseWithOptions(req *http.Request, conn net.Conn, rw *bufio.ReadWriter, opts *Options, sc *serverConn) *Response {
+	res := newResponse(req, conn, rw, opts.bufferSize(), opts, sc)
+	res.compress = opts.Compression
+	res.etag = opts.ETag
+	res.SetVectored(opts.Vectored)
+	if opts.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(opts.WriteTimeout))
+	}
+	return res
+}
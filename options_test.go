@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testOptions(opts *Options, raw string, handler http.HandlerFunc, t *testing.T) string {
+	s, _ := testRaw(opts, raw, func(res *Response) { handler(res, res.req) }, t)
+	return s
+}
+
+// testServeOptions is like testOptions, but calls the handler with Serve,
+// which recovers from its panic, and also returns the error returned by
+// FinishRequest.
+func testServeOptions(opts *Options, raw string, handler http.HandlerFunc, t *testing.T) (string, error) {
+	return testRaw(opts, raw, func(res *Response) { res.Serve(handler) }, t)
+}
+
+// testRaw reads the raw request from a net.Pipe, serves it on a response
+// with the options, and returns what the client read and the error
+// returned by FinishRequest.
+func testRaw(opts *Options, raw string, serve func(res *Response), t *testing.T) (string, error) {
+	client, conn := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		reader := NewBufioReader(conn)
+		writer := NewBufioWriter(conn)
+		rw := bufio.NewReadWriter(reader, writer)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			t.Error(err)
+			errc <- err
+			conn.Close()
+			return
+		}
+		res := NewResponseWithOptions(req, conn, rw, opts)
+		serve(res)
+		errc <- res.FinishRequest()
+		FreeResponse(res)
+		conn.Close()
+		FreeBufioReader(reader)
+		FreeBufioWriter(writer)
+	}()
+	go io.WriteString(client, raw)
+	b, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), <-errc
+}
+
+func TestNewResponseWithOptions(t *testing.T) {
+	const get = "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	const get10 = "GET / HTTP/1.0\r\nHost: localhost\r\n\r\n"
+	html := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body>Hello World</body></html>"))
+	}
+	text := strings.Repeat("Hello World!\r\n", 100)
+	tests := []struct {
+		name     string
+		opts     *Options
+		raw      string
+		handler  http.HandlerFunc
+		contains []string
+		excludes []string
+	}{
+		{"nil", nil, get, html,
+			[]string{"HTTP/1.1 200 OK\r\n", "Date: ", "Content-Type: text/html; charset=utf-8\r\n", "Content-Length: 37\r\n"},
+			[]string{"Server: "}},
+		{"sniff", &Options{DisableSniff: true}, get, html,
+			[]string{"Content-Length: 37\r\n"},
+			[]string{"Content-Type: "}},
+		{"date", &Options{DisableDate: true}, get, html,
+			[]string{"Content-Length: 37\r\n"},
+			[]string{"Date: "}},
+		{"handler date", &Options{DisableDate: true}, get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", "Mon, 02 Jan 2006 15:04:05 GMT")
+		}, []string{"Date: Mon, 02 Jan 2006 15:04:05 GMT\r\n"}, nil},
+		{"server", &Options{Server: "response"}, get, html,
+			[]string{"Server: response\r\n"}, nil},
+		{"handler server", &Options{Server: "response"}, get, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Server", "handler")
+		}, []string{"Server: handler\r\n"}, []string{"Server: response"}},
+		{"buffer size", &Options{BufferSize: 16}, get, html,
+			[]string{"Transfer-Encoding: chunked\r\n"}, []string{"Content-Length: "}},
+		{"large buffer", &Options{BufferSize: 4096}, get, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("a", 3000)))
+		}, []string{"Content-Length: 3000\r\n"}, []string{"Transfer-Encoding: "}},
+		{"version", nil, get10, html,
+			[]string{"HTTP/1.0 200 OK\r\n"}, nil},
+		{"version 1.1", &Options{Version: VersionHTTP11}, get10, html,
+			[]string{"HTTP/1.1 200 OK\r\n", "Content-Length: 37\r\n"}, []string{"Transfer-Encoding: "}},
+		{"compression", &Options{Compression: true}, strings.Replace(get, "\r\n\r\n", "\r\nAccept-Encoding: gzip\r\n\r\n", 1), func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(text))
+		}, []string{"Content-Encoding: gzip\r\n"}, nil},
+		{"etag", &Options{ETag: true}, get, html,
+			[]string{"Etag: \"25-"}, nil},
+		{"vectored", &Options{Vectored: true}, get, html,
+			[]string{"\r\n\r\n<html><body>Hello World</body></html>"}, nil},
+		{"write timeout", &Options{WriteTimeout: time.Minute}, get, html,
+			[]string{"Content-Length: 37\r\n"}, nil},
+	}
+	for _, test := range tests {
+		resp := testOptions(test.opts, test.raw, test.handler, t)
+		for _, s := range test.contains {
+			if !strings.Contains(resp, s) {
+				t.Errorf("%s: %q does not contain %q", test.name, resp, s)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(resp, s) {
+				t.Errorf("%s: %q contains %q", test.name, resp, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	acceptRanges  = "Accept-Ranges"
+	contentRange  = "Content-Range"
+	ifRange       = "If-Range"
+	lastModified  = "Last-Modified"
+	rangeHeader   = "Range"
+	rangeUnit     = "bytes"
+	byteRangesCT  = "multipart/byteranges; boundary="
+	rangeUnitSize = len(rangeUnit) + 1
+)
+
+// errNoOverlap is returned by parseRange if first-byte-pos of
+// all of the byte-range-spec values is greater than the content size.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// errInvalidRange is returned by parseRange if the Range header is malformed.
+var errInvalidRange = errors.New("invalid range")
+
+// ServeRange replies to the request with the size bytes of content,
+// honoring its Range and If-Range headers.
+//
+// A single range is answered with 206 Partial Content and a Content-Range
+// header, and is copied through ReadFrom, so that an *os.File is sent
+// with sendfile. Several ranges are answered with a multipart/byteranges
+// body. Ranges that don't overlap the content are answered with 416 Range
+// Not Satisfiable. If-Range is compared against the ETag and Last-Modified
+// headers set on w before the call, and the full content is sent if it
+// doesn't match.
+//
+// If the Content-Type header is not set, it is sniffed from content.
+func ServeRange(w *Response, content io.ReadSeeker, size int64) {
+	r := w.req
+	code := http.StatusOK
+	ctype := w.Header().Get(contentType)
+	if ctype == emptyString {
+		var buf [sniffLen]byte
+		n, _ := io.ReadFull(content, buf[:])
+		ctype = http.DetectContentType(buf[:n])
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "seeker can't seek", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(contentType, ctype)
+	}
+	sendSize := size
+	var ranges []httpRange
+	if rangeReq := r.Header.Get(rangeHeader); rangeReq != emptyString && checkIfRange(w, r) {
+		var err error
+		ranges, err = parseRange(rangeReq, size)
+		if err != nil {
+			if err == errNoOverlap {
+				w.Header().Set(contentRange, "bytes */"+strconv.FormatInt(size, 10))
+			}
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if sumRangesSize(ranges) > size {
+			// The total number of bytes in all the ranges
+			// is larger than the size of the file by
+			// itself, so this is probably an attack, or a
+			// dumb client. Ignore the range request.
+			ranges = nil
+		}
+	}
+	var mw *multipart.Writer
+	switch {
+	case len(ranges) == 1:
+		// RFC 7233, Section 4.1:
+		// "If a single part is being transferred, the server
+		// generating the 206 response MUST generate a
+		// Content-Range header field, describing what range
+		// of the selected representation is enclosed, and a
+		// payload consisting of the range.
+		// ...
+		// A server MUST NOT generate a multipart response to
+		// a request for a single range, since a client that
+		// does not request multiple parts might not support
+		// multipart responses."
+		ra := ranges[0]
+		if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		sendSize = ra.length
+		code = http.StatusPartialContent
+		w.Header().Set(contentRange, ra.contentRange(size))
+	case len(ranges) > 1:
+		sendSize = rangesMIMESize(ranges, ctype, size)
+		code = http.StatusPartialContent
+		mw = multipart.NewWriter(w)
+		w.Header().Set(contentType, byteRangesCT+mw.Boundary())
+	}
+	w.Header().Set(acceptRanges, rangeUnit)
+	w.Header().Set(contentLength, strconv.FormatInt(sendSize, 10))
+	w.WriteHeader(code)
+	if r.Method == head {
+		return
+	}
+	if mw == nil {
+		io.CopyN(w, content, sendSize)
+		return
+	}
+	for _, ra := range ranges {
+		if _, err := mw.CreatePart(ra.mimeHeader(ctype, size)); err != nil {
+			return
+		}
+		if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+			return
+		}
+		// The part writes straight through to w.
+		if _, err := io.CopyN(w, content, ra.length); err != nil {
+			return
+		}
+	}
+	mw.Close()
+}
+
+// checkIfRange reports whether the Range header of r applies, which is
+// when there is no If-Range header or it matches the ETag or the
+// Last-Modified header of w.
+func checkIfRange(w *Response, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != head {
+		return false
+	}
+	ir := r.Header.Get(ifRange)
+	if ir == emptyString {
+		return true
+	}
+	if etag, _ := scanETag(ir); etag != emptyString {
+		return etagStrongMatch(etag, w.Header().Get(eTag))
+	}
+	// The If-Range value is typically the ETag value, but it may also be
+	// the modtime date. See golang.org/issue/8367.
+	lm := w.Header().Get(lastModified)
+	if lm == emptyString {
+		return false
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	modtime, err := http.ParseTime(lm)
+	return err == nil && t.Equal(modtime)
+}
+
+// httpRange specifies the byte range to be sent to the client.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange parses a Range header string as per RFC 7233.
+// errNoOverlap is returned if none of the ranges overlap.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == emptyString {
+		return nil, nil // header not present
+	}
+	if !strings.HasPrefix(s, rangeUnit+"=") {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[rangeUnitSize:], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == emptyString {
+			continue
+		}
+		i := strings.IndexByte(ra, '-')
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+		start, end := textproto.TrimString(ra[:i]), textproto.TrimString(ra[i+1:])
+		var r httpRange
+		if start == emptyString {
+			// If no start is specified, end specifies the
+			// range start relative to the end of the file,
+			// and we are dealing with <suffix-length>
+			// which has to be a non-negative integer as per
+			// RFC 7233 Section 2.1 "Byte-Ranges".
+			if end == emptyString || end[0] == '-' {
+				return nil, errInvalidRange
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if i < 0 || err != nil {
+				return nil, errInvalidRange
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i >= size {
+				// If the range begins after the size of the content,
+				// then it does not overlap.
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == emptyString {
+				// If no end is specified, range extends to end of the file.
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errInvalidRange
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		// The specified ranges did not overlap with the content.
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// rangesMIMESize returns the number of bytes it takes to encode the
+// provided ranges as a multipart response.
+func rangesMIMESize(ranges []httpRange, contentType string, contentSize int64) (encSize int64) {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, contentSize))
+		encSize += ra.length
+	}
+	mw.Close()
+	encSize += int64(w)
+	return
+}
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, ra := range ranges {
+		size += ra.length
+	}
+	return
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestServeRange(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	f, err := ioutil.TempFile("", "range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write(content)
+	const modtime = "Mon, 02 Jan 2006 15:04:05 GMT"
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v1"`)
+		w.Header().Set("Last-Modified", modtime)
+		if r.URL.Path == "/file" {
+			ServeRange(w.(*Response), io.NewSectionReader(f, 0, int64(len(content))), int64(len(content)))
+			return
+		}
+		ServeRange(w.(*Response), bytes.NewReader(content), int64(len(content)))
+	}), t)
+	defer stop()
+	tests := []struct {
+		method  string
+		path    string
+		rang    string
+		ifRange string
+		code    int
+		body    string
+		cr      string
+	}{
+		{"GET", "/", "", "", 200, string(content), ""},
+		{"GET", "/", "bytes=0-4", "", 206, "01234", "bytes 0-4/36"},
+		{"GET", "/file", "bytes=0-4", "", 206, "01234", "bytes 0-4/36"},
+		{"GET", "/", "bytes=30-", "", 206, "uvwxyz", "bytes 30-35/36"},
+		{"GET", "/", "bytes=-3", "", 206, "xyz", "bytes 33-35/36"},
+		{"GET", "/", "bytes=34-100", "", 206, "yz", "bytes 34-35/36"},
+		{"GET", "/", "bytes=36-", "", 416, "", "bytes */36"},
+		{"GET", "/", "bytes=5-1", "", 416, "", ""},
+		{"GET", "/", "pages=1-2", "", 416, "", ""},
+		{"GET", "/", "bytes=0-4", `"v1"`, 206, "01234", "bytes 0-4/36"},
+		{"GET", "/", "bytes=0-4", `"v2"`, 200, string(content), ""},
+		{"GET", "/", "bytes=0-4", `W/"v1"`, 200, string(content), ""},
+		{"GET", "/", "bytes=0-4", modtime, 206, "01234", "bytes 0-4/36"},
+		{"GET", "/", "bytes=0-4", "Tue, 03 Jan 2006 15:04:05 GMT", 200, string(content), ""},
+		{"HEAD", "/", "bytes=0-4", "", 206, "", "bytes 0-4/36"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://"+addr+test.path, nil)
+		if test.rang != "" {
+			req.Header.Set("Range", test.rang)
+		}
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.rang, resp.StatusCode, test.code)
+			continue
+		}
+		if got := resp.Header.Get("Content-Range"); got != test.cr {
+			t.Errorf("%s %s: Content-Range %q, want %q", test.method, test.rang, got, test.cr)
+		}
+		if test.code == 416 {
+			continue
+		}
+		if string(body) != test.body {
+			t.Errorf("%s %s: body %q, want %q", test.method, test.rang, body, test.body)
+		}
+		if resp.Header.Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%s %s: Accept-Ranges %q", test.method, test.rang, resp.Header.Get("Accept-Ranges"))
+		}
+		if want := int64(len(test.body)); test.method == "GET" && resp.ContentLength != want {
+			t.Errorf("%s %s: Content-Length %d, want %d", test.method, test.rang, resp.ContentLength, want)
+		}
+	}
+}
+
+func TestServeRangeMultipart(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		ServeRange(w.(*Response), bytes.NewReader(content), int64(len(content)))
+	}), t)
+	defer stop()
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	req.Header.Set("Range", "bytes=0-1, 10-12, -2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length %s, body %d bytes", cl, len(body))
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var parts, ranges []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(part)
+		parts = append(parts, string(b))
+		ranges = append(ranges, part.Header.Get("Content-Range"))
+		if part.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("part Content-Type %q", part.Header.Get("Content-Type"))
+		}
+	}
+	if want := []string{"01", "abc", "yz"}; !reflect.DeepEqual(parts, want) {
+		t.Errorf("parts %q, want %q", parts, want)
+	}
+	if want := []string{"bytes 0-1/36", "bytes 10-12/36", "bytes 34-35/36"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ranges %q, want %q", ranges, want)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		size   int64
+		ranges []httpRange
+		err    error
+	}{
+		{"", 10, nil, nil},
+		{"bytes=", 10, nil, nil},
+		{"bytes=0-9", 10, []httpRange{{0, 10}}, nil},
+		{"bytes=5-", 10, []httpRange{{5, 5}}, nil},
+		{"bytes=-20", 10, []httpRange{{0, 10}}, nil},
+		{"bytes=0-0, -1", 10, []httpRange{{0, 1}, {9, 1}}, nil},
+		{"bytes=10-", 10, nil, errNoOverlap},
+		{"bytes=--5", 10, nil, errInvalidRange},
+		{"bytes=a-5", 10, nil, errInvalidRange},
+		{"bytes=5", 10, nil, errInvalidRange},
+		{"bits=0-1", 10, nil, errInvalidRange},
+	}
+	for _, test := range tests {
+		ranges, err := parseRange(test.s, test.size)
+		if err != test.err || !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("parseRange(%q) = %v, %v; want %v, %v", test.s, ranges, err, test.ranges, test.err)
+		}
+	}
+}
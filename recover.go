@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// Serve calls the handler with the response and its request, and
+// recovers from a panic in the handler. If the header has not been
+// written to the connection yet, the response is replaced with a 500
+// Internal Server Error; otherwise the body is cut short, and a chunked
+// body is left without its zero-length chunk. Either way FinishRequest
+// returns http.ErrAbortHandler and closes the connection.
+//
+// The panic is logged with the stack of the handler to the ErrorLog of
+// the options, unless its value is http.ErrAbortHandler, which aborts the
+// response silently.
+//
+// FinishRequest and FreeResponse must still be called after Serve.
+func (w *Response) Serve(handler http.Handler) {
+	defer func() {
+		if v := recover(); v != nil {
+			w.abort(v)
+		}
+	}()
+	handler.ServeHTTP(w, w.req)
+}
+
+// abort fails the response of a handler that panicked with v.
+func (w *Response) abort(v interface{}) {
+	if v != http.ErrAbortHandler {
+		const size = 64 << 10
+		buf := make([]byte, size)
+		buf = buf[:runtime.Stack(buf, false)]
+		w.options.logf("response: panic serving %v: %v\n%s", w.conn.RemoteAddr(), v, buf)
+	}
+	w.runFinishHooks()
+	if w.hijacked.isSet() {
+		// The connection belongs to the handler.
+		return
+	}
+	if !w.cw.wroteHeader {
+		w.wroteHeader = true
+		w.written = 0
+		w.cw.failHeader(http.ErrAbortHandler)
+		return
+	}
+	if w.err == nil {
+		w.err = http.ErrAbortHandler
+	}
+	w.closeAfterReply = true
+	// Whatever has been framed already is flushed, but the body is not
+	// ended, so that the client sees it cut short.
+	if w.cw.zw != nil {
+		freeCompressor(w.cw.encoding, w.cw.zw)
+		w.cw.zw = nil
+	}
+	w.cw.chunking = false
+}
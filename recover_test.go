@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeRecover(t *testing.T) {
+	const get = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+		logged  bool
+	}{
+		{"uncommitted", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Handler", "1")
+			w.Write([]byte("Hello World"))
+			panic("boom")
+		}, "HTTP/1.1 500 Internal Server Error\r\n", true},
+		{"committed", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(" World"))
+			panic("boom")
+		}, "HTTP/1.1 200 OK\r\n", true},
+		{"abort", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello"))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}, "HTTP/1.1 200 OK\r\n", false},
+	}
+	for _, test := range tests {
+		var logs bytes.Buffer
+		opts := &Options{ErrorLog: log.New(&logs, "", 0)}
+		raw, err := testServeOptions(opts, get, test.handler, t)
+		if err != http.ErrAbortHandler {
+			t.Errorf("%s: FinishRequest returned %v", test.name, err)
+		}
+		if !strings.HasPrefix(raw, test.want) {
+			t.Errorf("%s: got %q", test.name, raw)
+		}
+		if test.name == "uncommitted" && !strings.Contains(raw, "Content-Length: 0\r\nConnection: close\r\n") {
+			t.Errorf("%s: missing Connection: close in %q", test.name, raw)
+		}
+		if strings.Contains(raw, "X-Handler") || strings.HasSuffix(raw, "0\r\n\r\n") {
+			t.Errorf("%s: got %q", test.name, raw)
+		}
+		if logged := strings.Contains(logs.String(), "panic serving"); logged != test.logged {
+			t.Errorf("%s: logged %q", test.name, logs.String())
+		}
+		if test.logged && !strings.Contains(logs.String(), "goroutine ") {
+			t.Errorf("%s: no stack in %q", test.name, logs.String())
+		}
+	}
+}
+
+func TestServerRecover(t *testing.T) {
+	var logs bytes.Buffer
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})}
+	srv.ErrorLog = log.New(&logs, "", 0)
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(conn)
+		close(done)
+	}()
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	b, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if strings.Count(string(b), "HTTP/1.1 500 Internal Server Error\r\n") != 1 {
+		t.Errorf("got %q", b)
+	}
+	if !strings.Contains(logs.String(), "panic serving") {
+		t.Errorf("logged %q", logs.String())
+	}
+}
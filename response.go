@@ -6,29 +6,45 @@ package response
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/textproto"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 )
 
 const (
 	httpVersion        = "HTTP/1.1 "
+	httpVersion10      = "HTTP/1.0 "
 	chunk              = "%x\r\n"
 	contentLength      = "Content-Length"
 	transferEncoding   = "Transfer-Encoding"
 	contentType        = "Content-Type"
 	date               = "Date"
+	server             = "Server"
 	connection         = "Connection"
+	trailer            = "Trailer"
 	chunked            = "chunked"
+	closeConnection    = "close"
+	keepAlive          = "keep-alive"
+	upgrade            = "Upgrade"
+	expect             = "Expect"
+	continueExpected   = "100-continue"
 	defaultContentType = "text/plain; charset=utf-8"
 	head               = "HEAD"
+	identity           = "identity"
 	emptyString        = ""
 )
 
@@ -127,7 +143,14 @@ func FreeResponse(w http.ResponseWriter) {
 		return
 	}
 	if res, ok := w.(*Response); ok {
+		res.runFinishHooks()
+		buf := res.cw.buf
 		*res = Response{}
+		if cap(buf) == bufferBeforeChunkingSize {
+			// Keep the buffer of the vectored writes, which would be
+			// allocated again by putting it in a sync.Pool.
+			res.cw.buf = buf[:0]
+		}
 		responsePool.Put(res)
 	}
 }
@@ -144,22 +167,33 @@ func freeHeader(h http.Header) {
 
 // Response implements the http.ResponseWriter interface.
 type Response struct {
-	req           *http.Request
-	conn          net.Conn
-	wroteHeader   bool
-	rw            *bufio.ReadWriter
-	buffer        []byte
-	cw            chunkWriter
-	handlerHeader http.Header
-	setHeader     header
-	written       int64 // number of bytes written in body
-	noCache       bool
-	contentLength int64 // explicitly-declared Content-Length; or -1
-	status        int
-	hijacked      atomicBool
-	dateBuf       [len(TimeFormat)]byte
-	clenBuf       [10]byte
-	statusBuf     [3]byte
+	req             *http.Request
+	conn            net.Conn
+	wroteHeader     bool
+	rw              *bufio.ReadWriter
+	buffer          []byte
+	cw              chunkWriter
+	handlerHeader   http.Header
+	setHeader       header
+	written         int64 // number of bytes written in body
+	noCache         bool
+	contentLength   int64 // explicitly-declared Content-Length; or -1
+	status          int
+	trailers        []string // trailer keys declared in the Trailer header
+	hijacked        atomicBool
+	ecr             *expectContinueReader // non-nil if the client expects 100 Continue
+	compress        bool                  // compress the body if the client accepts it
+	etag            bool                  // generate an ETag for a fully buffered body
+	closeAfterReply bool                  // the connection must not be reused after this response
+	options         *Options
+	sc              *serverConn        // the connection of a Server; or nil
+	cancelCtx       context.CancelFunc // cancels the request's context; or nil
+	err             error              // the first write error; sticky
+	fullDuplex      bool               // the handler reads the request body while writing
+	finishHooks     []func()           // called once before the response finishes
+	dateBuf         [len(TimeFormat)]byte
+	clenBuf         [10]byte
+	statusBuf       [3]byte
 
 	bufferPool  *sync.Pool
 	handlerDone atomicBool // set true when the handler exits
@@ -178,6 +212,10 @@ func NewResponse(req *http.Request, conn net.Conn, rw *bufio.ReadWriter) *Respon
 // NewResponseSize returns a new response whose buffer has at least the specified
 // size.
 func NewResponseSize(req *http.Request, conn net.Conn, rw *bufio.ReadWriter, size int) *Response {
+	return newResponse(req, conn, rw, size, defaultOptions, nil)
+}
+
+func newResponse(req *http.Request, conn net.Conn, rw *bufio.ReadWriter, size int, opts *Options, sc *serverConn) *Response {
 	if rw == nil {
 		rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	}
@@ -185,15 +223,70 @@ func NewResponseSize(req *http.Request, conn net.Conn, rw *bufio.ReadWriter, siz
 	res := responsePool.Get().(*Response)
 	res.handlerHeader = headerPool.Get().(http.Header)
 	res.contentLength = -1
+	res.options = opts
+	res.sc = sc
 	res.req = req
 	res.conn = conn
 	res.rw = rw
 	res.cw.res = res
 	res.bufferPool = bufferPool
 	res.buffer = bufferPool.Get().([]byte)
+	if req.ProtoAtLeast(1, 1) && req.ContentLength != 0 && expectsContinue(req) {
+		res.ecr = &expectContinueReader{bw: rw.Writer, readCloser: req.Body, canWriteContinue: true}
+		req.Body = res.ecr
+	}
+	res.setState(http.StateActive)
 	return res
 }
 
+func expectsContinue(req *http.Request) bool {
+	return hasToken(req.Header.Get(expect), continueExpected)
+}
+
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// expectContinueReader wraps the body of a request that expects
+// 100 Continue, and writes the interim response on the first read.
+type expectContinueReader struct {
+	mu               sync.Mutex
+	bw               *bufio.Writer
+	readCloser       io.ReadCloser
+	canWriteContinue bool
+	closed           atomicBool
+	sawEOF           atomicBool
+}
+
+func (ecr *expectContinueReader) Read(p []byte) (n int, err error) {
+	if ecr.closed.isSet() {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	ecr.mu.Lock()
+	if ecr.canWriteContinue {
+		ecr.canWriteContinue = false
+		ecr.bw.Write(continueResponse)
+		ecr.bw.Flush()
+	}
+	ecr.mu.Unlock()
+	n, err = ecr.readCloser.Read(p)
+	if err == io.EOF {
+		ecr.sawEOF.setTrue()
+	}
+	return
+}
+
+func (ecr *expectContinueReader) Close() error {
+	ecr.closed.setTrue()
+	return ecr.readCloser.Close()
+}
+
+// disableContinue prevents the reader from sending 100 Continue once a
+// response has been started.
+func (ecr *expectContinueReader) disableContinue() {
+	ecr.mu.Lock()
+	ecr.canWriteContinue = false
+	ecr.mu.Unlock()
+}
+
 // Header returns the header map that will be sent by
 // WriteHeader.
 func (w *Response) Header() http.Header {
@@ -205,6 +298,9 @@ func (w *Response) Write(data []byte) (n int, err error) {
 	if w.hijacked.isSet() {
 		return 0, http.ErrHijacked
 	}
+	if w.err != nil {
+		return 0, w.err
+	}
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
@@ -212,6 +308,10 @@ func (w *Response) Write(data []byte) (n int, err error) {
 	if lenData == 0 {
 		return 0, nil
 	}
+	if w.cw.discard {
+		// The header was written as a 304 or 412 response.
+		return lenData, nil
+	}
 	if !w.bodyAllowed() {
 		return 0, http.ErrBodyNotAllowed
 	}
@@ -236,6 +336,92 @@ func (w *Response) Write(data []byte) (n int, err error) {
 	return w.cw.Write(data)
 }
 
+// writerOnly hides the io.ReaderFrom implementation of the writer.
+type writerOnly struct {
+	io.Writer
+}
+
+// ReadFrom implements the io.ReaderFrom interface.
+//
+// When src is an *os.File, or an *io.LimitedReader wrapping one, the
+// Content-Length is declared, the response is not chunked and the
+// connection is a *net.TCPConn, ReadFrom flushes the header and lets the
+// kernel copy the file to the connection with sendfile or splice.
+// Otherwise it copies src through Write.
+func (w *Response) ReadFrom(src io.Reader) (n int64, err error) {
+	if w.hijacked.isSet() {
+		return 0, http.ErrHijacked
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	bufferPool := assignBufferPool(copyBufferSize)
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	tcpConn, ok := w.conn.(*net.TCPConn)
+	if !ok || !isFile(src) {
+		return io.CopyBuffer(writerOnly{w}, src, buf)
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.cw.wroteHeader {
+		// Copy the first sniffLen bytes before switching to ReadFrom.
+		n0, err := io.CopyBuffer(writerOnly{w}, io.LimitReader(src, sniffLen), buf)
+		n += n0
+		if err != nil || n0 < sniffLen {
+			return n, err
+		}
+	}
+	if w.contentLength == -1 || !w.bodyAllowed() || w.req.Method == head || w.cw.discard {
+		n0, err := io.CopyBuffer(writerOnly{w}, src, buf)
+		return n + n0, err
+	}
+	// Make sure the header and the buffered body are written to the
+	// connection. Now that cw has been flushed, its chunking field is
+	// guaranteed initialized.
+	if err = w.FlushError(); err != nil {
+		return n, err
+	}
+	if w.cw.chunking || w.cw.discard {
+		n0, err := io.CopyBuffer(writerOnly{w}, src, buf)
+		return n + n0, err
+	}
+	// Never send more than the declared length.
+	remaining := w.contentLength - w.written
+	var n0 int64
+	if lr, ok := src.(*io.LimitedReader); ok && lr.N <= remaining {
+		n0, err = tcpConn.ReadFrom(lr)
+	} else if ok {
+		limited := &io.LimitedReader{R: lr.R, N: remaining}
+		n0, err = tcpConn.ReadFrom(limited)
+		lr.N -= n0
+	} else {
+		n0, err = tcpConn.ReadFrom(&io.LimitedReader{R: src, N: remaining})
+	}
+	n += n0
+	w.written += n0
+	if err != nil {
+		w.closeOnWriteError(err)
+		return n, err
+	}
+	// Anything beyond the declared length fails in Write.
+	n0, err = io.CopyBuffer(writerOnly{w}, src, buf)
+	return n + n0, err
+}
+
+// isFile reports whether src is an *os.File, or an *io.LimitedReader
+// wrapping one, which the kernel can copy to a connection. The file is
+// matched through syscall.Conn, since io.Copy hands ReadFrom an *os.File
+// without its WriteTo method.
+func isFile(src io.Reader) bool {
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src = lr.R
+	}
+	_, ok := src.(syscall.Conn)
+	return ok
+}
+
 // WriteHeader sends an HTTP response header with the provided
 // status code.
 func (w *Response) WriteHeader(code int) {
@@ -245,9 +431,26 @@ func (w *Response) WriteHeader(code int) {
 	if w.wroteHeader {
 		return
 	}
-	w.wroteHeader = true
 	checkWriteHeaderCode(code)
+	// Informational responses are written to the connection right away
+	// and don't latch the status. 101 Switching Protocols is final,
+	// since nothing else follows it on this protocol.
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		if code == http.StatusContinue && w.ecr != nil {
+			w.ecr.disableContinue()
+		}
+		w.writeInformational(code)
+		return
+	}
+	w.wroteHeader = true
 	w.status = code
+	if w.ecr != nil {
+		w.ecr.disableContinue()
+	}
+	if w.isTunnel() {
+		// The body is the tunnel, which is not framed.
+		return
+	}
 	if cl := w.handlerHeader.Get(contentLength); cl != emptyString {
 		v, err := strconv.ParseInt(cl, 10, 64)
 		if err == nil && v >= 0 {
@@ -256,11 +459,52 @@ func (w *Response) WriteHeader(code int) {
 		} else {
 			w.handlerHeader.Del(contentLength)
 		}
-	} else if te := w.handlerHeader.Get(transferEncoding); te != emptyString {
+	}
+	if te := w.handlerHeader.Get(transferEncoding); te != emptyString {
 		w.setHeader.transferEncoding = te
-		if strings.Contains(te, chunked) {
-			w.cw.chunking = true
+		if te != identity {
+			// A Transfer-Encoding overrides the Content-Length, which
+			// must not be sent with it. See RFC 7230, section 3.3.3.
+			w.contentLength = -1
+			w.setHeader.contentLength = emptyString
 		}
+		w.cw.chunking = w.chunked(te)
+	}
+}
+
+// chunked reports whether a body with the Transfer-Encoding te is framed
+// as chunks.
+func (w *Response) chunked(te string) bool {
+	return strings.Contains(te, chunked) && w.req.ProtoAtLeast(1, 1) &&
+		w.req.Method != head && bodyAllowedForStatus(w.status)
+}
+
+// isTunnel reports whether the response is a 2xx response to CONNECT,
+// after which the connection is a tunnel. Such a response has neither a
+// Content-Length nor a Transfer-Encoding. See RFC 7231, section 4.3.6.
+func (w *Response) isTunnel() bool {
+	return w.req.Method == http.MethodConnect && w.status >= 200 && w.status <= 299
+}
+
+// writeInformational writes a 1xx response with the handler's header and
+// flushes it. Per RFC 8297 the header is not cleared, so the fields sent
+// with 103 Early Hints are sent again with the final response.
+func (w *Response) writeInformational(code int) {
+	// A server must not send a 1xx response to an HTTP/1.0 client.
+	// See RFC 7231, section 6.2.
+	if !w.req.ProtoAtLeast(1, 1) {
+		return
+	}
+	// An invalid header fails the final response instead.
+	if cleanHeader(w.handlerHeader, w.options.HeaderPolicy) != nil {
+		return
+	}
+	bw := w.rw.Writer
+	writeStatusLine(bw, true, code, w.statusBuf[:0])
+	writeHeaderValues(bw, w.handlerHeader, nil)
+	bw.Write(crlf)
+	if err := bw.Flush(); err != nil {
+		w.closeOnWriteError(err)
 	}
 }
 
@@ -271,20 +515,97 @@ func (w *Response) WriteHeader(code int) {
 // will not do anything else with the connection.
 func (w *Response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if w.wroteHeader {
-		w.FinishRequest()
+		w.finishRequest(false)
 	}
 	if !w.hijacked.setTrue() {
 		return nil, nil, http.ErrHijacked
 	}
+	if w.sc != nil {
+		if err := w.sc.hijack(w.rw); err != nil {
+			return nil, nil, err
+		}
+	}
+	w.setState(http.StateHijacked)
 	return w.conn, w.rw, nil
 }
 
+var (
+	// ErrHeaderWritten is returned by Upgrade when the header has been
+	// written already.
+	ErrHeaderWritten = errors.New("response: header already written")
+
+	// ErrUpgrade is returned by Upgrade when the request is not an
+	// HTTP/1.1 request listing the protocol in its Upgrade header.
+	ErrUpgrade = errors.New("response: protocol upgrade not requested")
+)
+
+// Upgrade switches the connection to the protocol, which the request must
+// list in its Upgrade header. It writes a 101 Switching Protocols response
+// with the Connection and Upgrade headers, the extra headers and the ones
+// set by the handler, flushes it with anything else buffered, and
+// hijacks the connection.
+//
+// Upgrade fails without writing anything if the header has been written
+// already. The caller owns the returned connection, and the
+// bufio.ReadWriter, whose reader may hold data the client sent after
+// the request.
+func (w *Response) Upgrade(protocol string, extraHeaders http.Header) (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked.isSet() {
+		return nil, nil, http.ErrHijacked
+	}
+	if w.wroteHeader {
+		return nil, nil, ErrHeaderWritten
+	}
+	if !w.req.ProtoAtLeast(1, 1) || !w.requestsUpgrade(protocol) {
+		return nil, nil, ErrUpgrade
+	}
+	h := w.handlerHeader
+	for key, values := range extraHeaders {
+		h[key] = append(h[key], values...)
+	}
+	h.Set(connection, upgrade)
+	h.Set(upgrade, protocol)
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, rw, err := w.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.err != nil {
+		// The response failed the header policy, or could not be
+		// written.
+		conn.Close()
+		return nil, nil, w.err
+	}
+	return conn, rw, nil
+}
+
+// requestsUpgrade reports whether the request's Upgrade header lists the
+// protocol.
+func (w *Response) requestsUpgrade(protocol string) bool {
+	if protocol == emptyString || !validHeaderFieldValue(protocol) {
+		return false
+	}
+	protocol = strings.ToLower(protocol)
+	for _, v := range w.req.Header[upgrade] {
+		if hasToken(v, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
 // Flush implements the http.Flusher interface.
 //
 // Flush writes any buffered data to the underlying connection.
 func (w *Response) Flush() {
+	w.FlushError()
+}
+
+// FlushError is like Flush, but returns the first write error, as
+// http.ResponseController expects.
+func (w *Response) FlushError() error {
 	if w.hijacked.isSet() {
-		return
+		return http.ErrHijacked
 	}
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
@@ -292,20 +613,137 @@ func (w *Response) Flush() {
 	if !w.noCache {
 		if w.written > 0 {
 			w.cw.Write(w.buffer[:w.written])
-			w.written = 0
+		} else if !w.cw.wroteHeader {
+			// Write the header while the body is known to be empty
+			// if the handler has finished.
+			w.cw.writeHeader(nil)
 		}
+		// The header is committed now, so there is nothing left to gain
+		// from buffering the body.
+		w.noCache = true
 	}
 	w.cw.flush()
+	return w.err
+}
+
+// SetVectored sets whether the response sends the status line, the
+// header, the chunk framing and the body with vectored writes (writev).
+// Writes of at least 1KB are sent from the caller's slice without being
+// copied, together with the pending header and framing in one syscall.
+// It has no effect once the header has been written to the connection.
+func (w *Response) SetVectored(vectored bool) {
+	if w.cw.wroteHeader || w.cw.vectored == vectored {
+		return
+	}
+	w.cw.vectored = vectored
+	if vectored && w.cw.buf == nil {
+		w.cw.buf = assignBufferPool(bufferBeforeChunkingSize).Get().([]byte)[:0]
+	}
+}
+
+// ShouldClose reports whether the connection must be closed after this
+// response instead of reading the next request. The decision is final once
+// the header has been written to the connection, and FinishRequest closes
+// the connection when it returns true. It returns true after a write error.
+func (w *Response) ShouldClose() bool {
+	return w.closeAfterReply
+}
+
+// SetReadDeadline sets the deadline for reading the entire request,
+// including the body. It is called by http.ResponseController.
+func (w *Response) SetReadDeadline(deadline time.Time) error {
+	if w.hijacked.isSet() {
+		return http.ErrHijacked
+	}
+	return w.conn.SetReadDeadline(deadline)
+}
+
+// SetWriteDeadline sets the deadline for writing the response. It is
+// called by http.ResponseController.
+func (w *Response) SetWriteDeadline(deadline time.Time) error {
+	if w.hijacked.isSet() {
+		return http.ErrHijacked
+	}
+	return w.conn.SetWriteDeadline(deadline)
+}
+
+// EnableFullDuplex indicates that the handler will interleave reads from
+// the request body with writes to the response. Otherwise the unread
+// part of the body is consumed before the header is written, so that a
+// client sending the whole request before reading the response doesn't
+// deadlock. It is called by http.ResponseController.
+func (w *Response) EnableFullDuplex() error {
+	w.fullDuplex = true
+	return nil
+}
+
+// Unwrap returns the *Response under w, following the Unwrap methods of
+// the writers wrapping it, or nil if there is none.
+func Unwrap(w http.ResponseWriter) *Response {
+	for {
+		switch t := w.(type) {
+		case *Response:
+			return t
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// FinishRequest finishes a request, and returns the first error writing
+// the response to the connection, or ErrShortBody if the handler wrote
+// less than the Content-Length it declared.
+func (w *Response) FinishRequest() error {
+	if w.handlerDone.isSet() {
+		return w.err
+	}
+	w.finishRequest(true)
+	if w.closeAfterReply {
+		w.setState(http.StateClosed)
+	} else {
+		w.setState(http.StateIdle)
+	}
+	return w.err
+}
+
+// setState reports the state of the connection to the ConnState hook
+// of the options, and to the Server serving the connection.
+func (w *Response) setState(state http.ConnState) {
+	if w.sc != nil {
+		w.sc.setState(state)
+	} else if hook := w.options.ConnState; hook != nil {
+		hook(w.conn, state)
+	}
 }
 
-// FinishRequest finishes a request.
-func (w *Response) FinishRequest() {
+// finishRequest finishes the request, and closes the connection if
+// closeConn is true and the connection must not be reused.
+func (w *Response) finishRequest(closeConn bool) {
 	if !w.handlerDone.setTrue() {
 		return
 	}
+	w.runFinishHooks()
 	w.Flush()
 	w.cw.close()
-	w.rw.Flush()
+	w.cw.flush()
+	if closeConn && w.shortBody() {
+		// The client is waiting for the rest of the body, and would read
+		// the next response as part of it.
+		if w.err == nil {
+			w.err = ErrShortBody
+		}
+		w.closeAfterReply = true
+	}
+	if closeConn {
+		// A hijacking handler still owns the request, whose context is
+		// cancelled when the handler returns.
+		w.cancel()
+	}
+	if closeConn && w.closeAfterReply {
+		w.conn.Close()
+	}
 	// Close the body (regardless of w.closeAfterReply) so we can
 	// re-use its bufio.Reader later safely.
 	w.req.Body.Close()
@@ -320,6 +758,62 @@ func (w *Response) FinishRequest() {
 	w.buffer = nil
 }
 
+// onFinish registers fn to be called once when the response finishes,
+// aborts or is freed, before the response is written to. It stops what
+// the handler left writing to the response in the background.
+func (w *Response) onFinish(fn func()) {
+	w.finishHooks = append(w.finishHooks, fn)
+}
+
+// runFinishHooks calls the functions registered with onFinish.
+func (w *Response) runFinishHooks() {
+	hooks := w.finishHooks
+	w.finishHooks = nil
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// ErrShortBody is returned by FinishRequest when the handler wrote less
+// than the Content-Length it declared. The connection is closed, so that
+// the client sees the body cut short.
+var ErrShortBody = errors.New("response: wrote less than the declared Content-Length")
+
+// closeOnWriteError records the first write error, which every later
+// write returns, closes the connection and cancels the request's context,
+// since the client is gone.
+func (w *Response) closeOnWriteError(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+	w.closeAfterReply = true
+	w.conn.Close()
+	w.cancel()
+}
+
+// shortBody reports whether the body is shorter than the Content-Length
+// declared by the handler.
+func (w *Response) shortBody() bool {
+	return w.contentLength != -1 && w.written < w.contentLength && w.req.Method != head &&
+		bodyAllowedForStatus(w.status) && !w.cw.discard
+}
+
+// Err returns the first error writing the response to the connection,
+// ErrShortBody if the handler wrote less than the Content-Length it
+// declared, or ErrInvalidHeader if the HeaderFail policy failed the
+// response, after which the connection is closed and must not serve more
+// requests.
+func (w *Response) Err() error {
+	return w.err
+}
+
+// cancel cancels the request's context if the response has one.
+func (w *Response) cancel() {
+	if w.cancelCtx != nil {
+		w.cancelCtx()
+	}
+}
+
 // bodyAllowed reports whether a Write is allowed for this response type.
 // It's illegal to call this before the header has been flushed.
 func (w *Response) bodyAllowed() bool {
@@ -366,6 +860,17 @@ const commaSpaceChunked = ", chunked"
 // but otherwise it's somewhat arbitrary.
 const bufferBeforeChunkingSize = 2048
 
+// sniffLen is the number of bytes DetectContentType considers.
+const sniffLen = 512
+
+// vectoredWriteSize is the smallest write that vectored responses send
+// from the caller's slice instead of copying it.
+const vectoredWriteSize = 1024
+
+// copyBufferSize is the size of the buffer ReadFrom copies through when
+// the kernel can't copy the body.
+const copyBufferSize = 32 * 1024
+
 // chunkWriter writes to a response's conn buffer, and is the writer
 // wrapped by the response.bufw buffered writer.
 //
@@ -386,20 +891,89 @@ type chunkWriter struct {
 
 	// set by the writeHeader method:
 	chunking bool // using chunked transfer encoding for reply body
+
+	// set by the startCompression method:
+	zw       compressor    // compresses a streamed body; or nil
+	zbuf     *bytes.Buffer // the compressed body of a fully buffered response; or nil
+	encoding string        // content coding of zw
+
+	// set by the preconditionFailed method:
+	discard bool // the response became a 304 or 412 and the body is dropped
+
+	// set by the SetVectored method:
+	vectored bool        // sending the header, framing and body with writev
+	buf      []byte      // header and chunk framing waiting for the next writev
+	iov      [3][]byte   // backing array of vec
+	vec      net.Buffers // pending buf, a caller-owned payload and its CRLF
+}
+
+// writer is implemented by *bufio.Writer and by the byteBuffer that
+// collects the header for vectored writes.
+type writer interface {
+	io.Writer
+	io.StringWriter
+	io.ByteWriter
+}
+
+// byteBuffer is an append-only writer.
+type byteBuffer []byte
+
+func (b *byteBuffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+func (b *byteBuffer) WriteString(s string) (int, error) {
+	*b = append(*b, s...)
+	return len(s), nil
+}
+
+func (b *byteBuffer) WriteByte(c byte) error {
+	*b = append(*b, c)
+	return nil
+}
+
+// out returns the writer the header and the chunk framing are written to.
+func (cw *chunkWriter) out() writer {
+	if cw.vectored {
+		return (*byteBuffer)(&cw.buf)
+	}
+	return cw.res.rw.Writer
 }
 
 func (cw *chunkWriter) Write(p []byte) (n int, err error) {
 	if !cw.wroteHeader {
 		cw.writeHeader(p)
 	}
-	if cw.res.req.Method == head {
+	if cw.res.req.Method == head || cw.discard {
 		// Eat writes.
 		return len(p), nil
 	}
+	if cw.zw != nil {
+		return cw.zw.Write(p)
+	}
+	if cw.zbuf != nil {
+		// p was compressed into zbuf when the header was written.
+		_, err = cw.writeChunk(cw.zbuf.Bytes())
+		freeCompressBuffer(cw.zbuf)
+		cw.zbuf = nil
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return cw.writeChunk(p)
+}
+
+// writeChunk writes p to the connection, framed as a chunk when chunking.
+func (cw *chunkWriter) writeChunk(p []byte) (n int, err error) {
+	if cw.vectored {
+		return cw.writeVectored(p)
+	}
 	if cw.chunking {
 		_, err = fmt.Fprintf(cw.res.rw, chunk, len(p))
 		if err != nil {
-			cw.res.conn.Close()
+			cw.res.closeOnWriteError(err)
 			return
 		}
 	}
@@ -408,29 +982,97 @@ func (cw *chunkWriter) Write(p []byte) (n int, err error) {
 		_, err = cw.res.rw.Write(crlf)
 	}
 	if err != nil {
-		cw.res.conn.Close()
+		cw.res.closeOnWriteError(err)
 	}
 	return
 }
 
+// writeVectored copies small writes after the pending header and chunk
+// framing, and sends large ones from p together with them in a single
+// writev, so that p is never copied.
+func (cw *chunkWriter) writeVectored(p []byte) (n int, err error) {
+	if cw.chunking {
+		cw.buf = strconv.AppendInt(cw.buf, int64(len(p)), 16)
+		cw.buf = append(cw.buf, crlf...)
+	}
+	if len(p) < vectoredWriteSize {
+		cw.buf = append(cw.buf, p...)
+		if cw.chunking {
+			cw.buf = append(cw.buf, crlf...)
+		}
+		if len(cw.buf) >= bufferBeforeChunkingSize {
+			if err = cw.flushVector(); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	cw.vec = append(cw.iov[:0], cw.buf, p)
+	if cw.chunking {
+		cw.vec = append(cw.vec, crlf)
+	}
+	if err = cw.writeBuffers(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flushVector writes the pending header and chunk framing.
+func (cw *chunkWriter) flushVector() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	cw.vec = append(cw.iov[:0], cw.buf)
+	return cw.writeBuffers()
+}
+
+// writeBuffers writes vec to the connection, after anything still
+// buffered in the conn's bufio writer.
+func (cw *chunkWriter) writeBuffers() (err error) {
+	w := cw.res
+	if w.rw.Writer.Buffered() > 0 {
+		err = w.rw.Flush()
+	}
+	if err == nil {
+		_, err = cw.vec.WriteTo(w.conn)
+	}
+	cw.iov = [3][]byte{}
+	cw.buf = cw.buf[:0]
+	if err != nil {
+		w.closeOnWriteError(err)
+	}
+	return err
+}
+
 func (cw *chunkWriter) flush() {
 	if !cw.wroteHeader {
 		cw.writeHeader(nil)
 	}
-	cw.res.rw.Flush()
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if cw.vectored {
+		cw.flushVector()
+	}
+	if err := cw.res.rw.Flush(); err != nil {
+		cw.res.closeOnWriteError(err)
+	}
 }
 
 func (cw *chunkWriter) close() {
 	if !cw.wroteHeader {
 		cw.writeHeader(nil)
 	}
+	if cw.zw != nil {
+		cw.zw.Close()
+		freeCompressor(cw.encoding, cw.zw)
+		cw.zw = nil
+	}
 	if cw.chunking {
-		bw := cw.res.rw // conn's bufio writer
+		bw := cw.out()
 		// zero chunk to mark EOF
 		bw.Write(zerocrlf)
-		//if trailers := cw.res.finalTrailers(); trailers != nil {
-		//	trailers.Write(bw) // the writer handles noting errors
-		//}
+		cw.res.writeTrailers(bw)
 		// final blank line after the trailers (whether
 		// present or not)
 		bw.Write(crlf)
@@ -444,59 +1086,406 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 	cw.wroteHeader = true
 	var w = cw.res
 	isHEAD := w.req.Method == "HEAD"
+	is11 := w.req.ProtoAtLeast(1, 1)
+
+	if err := cleanHeader(w.handlerHeader, w.options.HeaderPolicy); err != nil {
+		cw.failHeader(err)
+	} else if len(w.setHeader.transferEncoding) > 0 {
+		// WriteHeader copied the Transfer-Encoding before it was cleaned.
+		if te := w.handlerHeader.Get(transferEncoding); te != w.setHeader.transferEncoding {
+			w.setHeader.transferEncoding = te
+			cw.chunking = w.chunked(te)
+		}
+	}
+
+	// Don't write out the fake "Trailer:foo" keys. See http.TrailerPrefix.
+	trailers := false
+	for key := range w.handlerHeader {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			trailers = true
+			break
+		}
+	}
+	for _, v := range w.handlerHeader[trailer] {
+		trailers = true
+		foreachHeaderElement(v, w.declareTrailer)
+	}
+
+	generated := w.etag && cw.generateETag(p)
+	if code := w.checkPreconditions(); code != 0 {
+		cw.preconditionFailed(code)
+	}
+	if w.compress {
+		cw.startCompression(p, isHEAD, trailers)
+	}
+	w.discardBody()
+	if generated && (cw.zbuf != nil || cw.zw != nil) {
+		// The compressed body is only semantically equivalent.
+		w.handlerHeader.Set(eTag, "W/"+w.handlerHeader.Get(eTag))
+	}
 
-	w.setHeader.date = appendTime(cw.res.dateBuf[:0], time.Now())
-	if len(w.setHeader.contentLength) > 0 {
+	if d := w.handlerHeader.Get(date); d != emptyString {
+		w.setHeader.date = append(w.dateBuf[:0], d...)
+	} else if !w.options.DisableDate {
+		w.setHeader.date = appendTime(w.dateBuf[:0], time.Now())
+	}
+	if w.options.Server != emptyString && len(w.handlerHeader[server]) == 0 && validHeaderFieldValue(w.options.Server) {
+		w.setHeader.server = w.options.Server
+	}
+	// Frame the body following RFC 7230, section 3.3.
+	te := w.setHeader.transferEncoding
+	switch {
+	case !bodyAllowedForStatus(w.status) || w.isTunnel():
+		// A 1xx, 204 or 304 response has no body, and the body of a
+		// tunnel is not framed.
+		cw.chunking = false
+		w.setHeader.transferEncoding = emptyString
+		w.setHeader.contentLength = emptyString
+	case isHEAD:
+		cw.chunking = false
+		w.setHeader.transferEncoding = emptyString
+		if len(w.setHeader.contentLength) == 0 && te == emptyString && !w.noCache && w.handlerDone.isSet() && !trailers && len(p) > 0 {
+			w.setContentLength(len(p))
+		}
+	case len(w.setHeader.contentLength) > 0:
+		cw.chunking = false
+		w.setHeader.transferEncoding = emptyString
+	case te == identity:
+		// The body is delimited by closing the connection.
 		cw.chunking = false
-	} else if cw.chunking {
-	} else if w.noCache {
+		w.setHeader.transferEncoding = emptyString
+	case !is11:
+		// HTTP/1.0 clients can't decode chunks, so a body of unknown
+		// length is delimited by closing the connection.
+		cw.chunking = false
+		w.setHeader.transferEncoding = emptyString
+		if te == emptyString && !w.noCache && w.handlerDone.isSet() {
+			w.setContentLength(len(p))
+		}
+	case cw.chunking:
+		// The handler's Transfer-Encoding is chunked already.
+	case te != emptyString || w.noCache || !w.handlerDone.isSet() || trailers:
+		// The chunked coding must be the last one applied.
 		cw.chunking = true
-		if len(w.setHeader.transferEncoding) > 0 {
-			if !strings.Contains(w.setHeader.transferEncoding, chunked) {
-				w.setHeader.transferEncoding += commaSpaceChunked
-			}
-		} else {
+		if te == emptyString {
 			w.setHeader.transferEncoding = chunked
+		} else {
+			w.setHeader.transferEncoding = te + commaSpaceChunked
 		}
-	} else if w.handlerDone.isSet() && bodyAllowedForStatus(w.status) && w.handlerHeader.Get(contentLength) == "" && (!w.noCache || !isHEAD || len(p) > 0) {
-		w.contentLength = int64(len(p))
-		var clen = strconv.AppendInt(w.clenBuf[:0], int64(len(p)), 10)
-		w.setHeader.contentLength = *(*string)(unsafe.Pointer(&clen))
+	default:
+		w.setContentLength(len(p))
+	}
+	if w.status == http.StatusNotModified {
+		// See RFC 7232, section 4.1.
+		w.setHeader.contentType = emptyString
+		w.handlerHeader.Del(contentType)
 	}
 	if ct := w.handlerHeader.Get(contentType); ct != emptyString {
 		w.setHeader.contentType = ct
-	} else {
-		if !cw.chunking && len(p) > 0 {
+	} else if w.setHeader.contentType == emptyString {
+		// As net/http does, a body with a Transfer-Encoding or a
+		// Content-Encoding set by the handler is not sniffed.
+		sniff := bodyAllowedForStatus(w.status) && !w.isTunnel() && !cw.discard && te == emptyString &&
+			w.handlerHeader.Get(contentEncoding) == emptyString
+		if sniff && !w.options.DisableSniff && len(p) > 0 {
 			w.setHeader.contentType = http.DetectContentType(p)
 		}
 	}
-	if co := w.handlerHeader.Get(connection); co != emptyString {
-		w.setHeader.connection = co
+	cw.keepAlive(isHEAD)
+	bw := cw.out()
+	writeStatusLine(bw, is11 || w.options.Version == VersionHTTP11, w.status, w.statusBuf[:0])
+	w.setHeader.Write(bw)
+	writeHeaderValues(bw, w.handlerHeader, w.trailers)
+	bw.Write(crlf)
+}
+
+// maxPostHandlerReadBytes is the max number of Request.Body bytes not
+// consumed by a handler that are read before the header is written.
+// Beyond that the connection is closed.
+const maxPostHandlerReadBytes = 256 << 10
+
+// discardBody consumes the request body the handler hasn't read, unless
+// full duplex is enabled, the connection is closing anyway, or the client
+// expects 100 Continue, in which case keepAlive closes the connection.
+func (w *Response) discardBody() {
+	if w.req.ContentLength == 0 || w.req.Body == nil || w.fullDuplex || w.closeAfterReply || w.req.Close || w.ecr != nil {
+		return
 	}
-	w.rw.WriteString(httpVersion)
-	if text := http.StatusText(w.status); len(text) > 0 {
-		w.rw.Write(strconv.AppendInt(w.statusBuf[:0], int64(w.status), 10))
-		w.rw.WriteByte(' ')
-		w.rw.WriteString(text)
-		w.rw.Write(crlf)
-	} else {
-		// don't worry about performance
-		fmt.Fprintf(w.rw, "%03d status code %d\r\n", w.status, w.status)
+	n, err := io.CopyN(ioutil.Discard, w.req.Body, maxPostHandlerReadBytes+1)
+	if n > maxPostHandlerReadBytes || err != nil && err != io.EOF && err != http.ErrBodyReadAfterClose {
+		w.closeAfterReply = true
 	}
-	w.setHeader.Write(w.rw.Writer)
-	for key := range w.handlerHeader {
-		value := w.handlerHeader.Get(key)
-		if key == date || key == contentLength || key == transferEncoding || key == contentType || key == connection {
+}
+
+// excludedHeader reports whether the key is written by the header struct
+// or as a trailer instead of being copied from the handler's header.
+func excludedHeader(key string) bool {
+	switch key {
+	case date, contentLength, transferEncoding, contentType, connection:
+		return true
+	}
+	return strings.HasPrefix(key, http.TrailerPrefix)
+}
+
+type headerSorter struct {
+	keys []string
+}
+
+var headerSorterPool = sync.Pool{
+	New: func() interface{} {
+		return new(headerSorter)
+	},
+}
+
+var headerNewlineToSpace = strings.NewReplacer("\n", " ", "\r", " ")
+
+// writeHeaderValues writes every value of every key in h, except the
+// excluded ones and the declared trailers, one line per value. The keys
+// are sorted and the values are cleaned the same way as
+// http.Header.Write, so that multi-valued headers such as Set-Cookie
+// reach the wire unchanged.
+func writeHeaderValues(w writer, h http.Header, trailers []string) {
+	hs := headerSorterPool.Get().(*headerSorter)
+	for key := range h {
+		if len(key) > 0 && !excludedHeader(key) && !isTrailer(key, trailers) {
+			hs.keys = append(hs.keys, key)
+		}
+	}
+	sort.Strings(hs.keys)
+	for _, key := range hs.keys {
+		writeHeaderLines(w, key, h[key])
+	}
+	for i := range hs.keys {
+		hs.keys[i] = emptyString
+	}
+	hs.keys = hs.keys[:0]
+	headerSorterPool.Put(hs)
+}
+
+// isTrailer reports whether the key is one of the trailers.
+func isTrailer(key string, trailers []string) bool {
+	for _, k := range trailers {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHeaderLines writes one header line for each value of the key.
+func writeHeaderLines(w writer, key string, values []string) {
+	for _, value := range values {
+		value = headerNewlineToSpace.Replace(value)
+		value = textproto.TrimString(value)
+		w.WriteString(key)
+		w.Write(colonSpace)
+		w.WriteString(value)
+		w.Write(crlf)
+	}
+}
+
+// badTrailer is the set of header keys that must not be sent as trailers.
+// See RFC 7230, section 4.1.2.
+var badTrailer = map[string]bool{
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Expect":              true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Range":               true,
+	"Realm":               true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Www-Authenticate":    true,
+}
+
+// declareTrailer is called for each Trailer header when the
+// response header is written. It notes that a header will need to be
+// written in the trailers at the end of the response.
+func (w *Response) declareTrailer(key string) {
+	key = http.CanonicalHeaderKey(key)
+	if badTrailer[key] {
+		return
+	}
+	w.trailers = append(w.trailers, key)
+}
+
+// writeTrailers writes the trailers declared in the Trailer header and
+// the ones set with the http.TrailerPrefix after the zero chunk.
+func (w *Response) writeTrailers(bw writer) {
+	for key, values := range w.handlerHeader {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			w.writeTrailer(bw, key[len(http.TrailerPrefix):], values)
+		}
+	}
+	for _, key := range w.trailers {
+		w.writeTrailer(bw, key, w.handlerHeader[key])
+	}
+}
+
+// writeTrailer writes the values of a trailer, applying the header
+// policy, under which an invalid trailer is dropped rather than failed.
+func (w *Response) writeTrailer(bw writer, key string, values []string) {
+	if !validHeaderFieldName(key) {
+		return
+	}
+	policy := w.options.HeaderPolicy
+	if policy == HeaderFail {
+		policy = HeaderDrop
+	}
+	values, _ = cleanValues(values, policy)
+	writeHeaderLines(bw, key, values)
+}
+
+// foreachHeaderElement splits v according to the "#rule" construction
+// in RFC 7230 section 7 and calls fn for each non-empty element.
+func foreachHeaderElement(v string, fn func(string)) {
+	v = textproto.TrimString(v)
+	if v == emptyString {
+		return
+	}
+	if !strings.Contains(v, ",") {
+		fn(v)
+		return
+	}
+	for _, f := range strings.Split(v, ",") {
+		if f = textproto.TrimString(f); f != emptyString {
+			fn(f)
+		}
+	}
+}
+
+// setContentLength sets the Content-Length computed for a body that was
+// fully buffered when the handler finished.
+func (w *Response) setContentLength(n int) {
+	w.contentLength = int64(n)
+	var clen = strconv.AppendInt(w.clenBuf[:0], int64(n), 10)
+	w.setHeader.contentLength = *(*string)(unsafe.Pointer(&clen))
+}
+
+// keepAlive decides whether the connection can be reused after the reply,
+// following RFC 7230 section 6.3, and sets the Connection header to match.
+func (cw *chunkWriter) keepAlive(isHEAD bool) {
+	w := cw.res
+	co := w.handlerHeader.Get(connection)
+	hasCL := len(w.setHeader.contentLength) > 0
+	bodyAllowed := bodyAllowedForStatus(w.status)
+	is11 := w.req.ProtoAtLeast(1, 1)
+	// An HTTP/1.0 client only keeps the connection alive if it asked
+	// for it and the body is delimited by its length.
+	wants10KeepAlive := !is11 && hasToken(w.req.Header.Get(connection), keepAlive)
+	if wants10KeepAlive && (isHEAD || hasCL || !bodyAllowed) {
+		if co == emptyString {
+			co = keepAlive
+		}
+	} else if !is11 || w.req.Close {
+		w.closeAfterReply = true
+	}
+	// A server shutting down closes the connection after the reply.
+	if w.sc != nil && w.sc.server.shuttingDown() {
+		w.closeAfterReply = true
+	}
+	if hasToken(co, closeConnection) {
+		w.closeAfterReply = true
+	}
+	// Without a length or chunking the end of the body is signaled
+	// by closing the connection.
+	if bodyAllowed && !isHEAD && !hasCL && !cw.chunking {
+		w.closeAfterReply = true
+	}
+	// If the client wanted a 100-continue but we never finished reading
+	// their request body, the next bytes on the wire may or may not be
+	// the rest of it, so don't reuse this connection.
+	if w.ecr != nil && !w.ecr.sawEOF.isSet() {
+		w.closeAfterReply = true
+	}
+	// Only override the Connection header if it is not a successful
+	// protocol switch response or tunnel.
+	if w.closeAfterReply && !hasToken(co, closeConnection) && !w.isProtocolSwitch() && !w.isTunnel() {
+		if is11 {
+			co = closeConnection
+		} else {
+			co = emptyString
+		}
+	}
+	w.setHeader.connection = co
+}
+
+// isProtocolSwitch reports whether the response switches to the protocol
+// in its Upgrade header.
+func (w *Response) isProtocolSwitch() bool {
+	return w.status == http.StatusSwitchingProtocols && len(w.handlerHeader[upgrade]) > 0
+}
+
+// hasToken reports whether token appears with v, ASCII
+// case-insensitive, with space or comma boundaries.
+// token must be all lowercase.
+// v may contain mixed cased.
+func hasToken(v, token string) bool {
+	if len(token) > len(v) || token == emptyString {
+		return false
+	}
+	if v == token {
+		return true
+	}
+	for sp := 0; sp <= len(v)-len(token); sp++ {
+		// Check that first character is good.
+		// The token is ASCII, so checking only a single byte
+		// is sufficient. We skip this potential starting
+		// position if both the first byte and its potential
+		// ASCII uppercase equivalent (b|0x20) don't match.
+		// False positives ('^' => '~') are caught by EqualFold.
+		if b := v[sp]; b != token[0] && b|0x20 != token[0] {
 			continue
 		}
-		if len(key) > 0 && len(value) > 0 {
-			w.rw.WriteString(key)
-			w.rw.Write(colonSpace)
-			w.rw.WriteString(value)
-			w.rw.Write(crlf)
+		// Check that start pos is on a valid token boundary.
+		if sp > 0 && !isTokenBoundary(v[sp-1]) {
+			continue
+		}
+		// Check that end pos is on a valid token boundary.
+		if endPos := sp + len(token); endPos != len(v) && !isTokenBoundary(v[endPos]) {
+			continue
 		}
+		if strings.EqualFold(v[sp:sp+len(token)], token) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTokenBoundary(b byte) bool {
+	return b == ' ' || b == ',' || b == '\t'
+}
+
+// writeStatusLine writes an HTTP/1.x Status-Line (RFC 7230 Section 3.1.2)
+// to bw. is11 is whether the HTTP request is HTTP/1.1. false means HTTP/1.0.
+// scratch is used to format the code without allocating.
+func writeStatusLine(bw writer, is11 bool, code int, scratch []byte) {
+	if is11 {
+		bw.WriteString(httpVersion)
+	} else {
+		bw.WriteString(httpVersion10)
+	}
+	if text := http.StatusText(code); len(text) > 0 {
+		bw.Write(strconv.AppendInt(scratch, int64(code), 10))
+		bw.WriteByte(' ')
+		bw.WriteString(text)
+		bw.Write(crlf)
+	} else {
+		// don't worry about performance
+		fmt.Fprintf(bw, "%03d status code %d\r\n", code, code)
 	}
-	w.rw.Write(crlf)
 }
 
 // TimeFormat is the time format to use when generating times in HTTP
@@ -535,6 +1524,7 @@ type header struct {
 	contentType      string
 	connection       string
 	transferEncoding string
+	server           string
 }
 
 // Sorted the same as Header.Write's loop.
@@ -543,6 +1533,7 @@ var headerKeys = [][]byte{
 	[]byte("Content-Type"),
 	[]byte("Connection"),
 	[]byte("Transfer-Encoding"),
+	[]byte("Server"),
 }
 var (
 	headerDate = []byte("Date: ")
@@ -558,13 +1549,13 @@ var (
 // This method has a value receiver, despite the somewhat large size
 // of h, because it prevents an allocation. The escape analysis isn't
 // smart enough to realize this function doesn't mutate h.
-func (h header) Write(w *bufio.Writer) {
+func (h header) Write(w writer) {
 	if h.date != nil {
 		w.Write(headerDate)
 		w.Write(h.date)
 		w.Write(crlf)
 	}
-	for i, v := range []string{h.contentLength, h.contentType, h.connection, h.transferEncoding} {
+	for i, v := range []string{h.contentLength, h.contentType, h.connection, h.transferEncoding, h.server} {
 		if len(v) > 0 {
 			w.Write(headerKeys[i])
 			w.Write(colonSpace)
@@ -11,8 +11,13 @@ import (
 	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -73,6 +78,120 @@ func testHeader(method, url string, status int, result string, header map[string
 	}
 }
 
+func testHeaderValues(url string, header http.Header, t *testing.T) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxConnsPerHost:   1,
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp.Body.Close()
+	for k, v := range header {
+		if !reflect.DeepEqual(resp.Header[k], v) {
+			t.Error(k, v, resp.Header[k])
+		}
+	}
+}
+
+func testTrailer(url string, result string, trailer http.Header, t *testing.T) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxConnsPerHost:   1,
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	if body, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Error(err)
+	} else if string(body) != result {
+		t.Error(string(body))
+	}
+	if !reflect.DeepEqual(resp.Trailer, trailer) {
+		t.Error(resp.Trailer)
+	}
+}
+
+func testEarlyHints(url string, result string, t *testing.T) {
+	var codes []int
+	var links []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			codes = append(codes, code)
+			links = append(links, header.Get("Link"))
+			return nil
+		},
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxConnsPerHost:   1,
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error(resp.StatusCode)
+	} else if body, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Error(err)
+	} else if string(body) != result {
+		t.Error(string(body))
+	}
+	if !reflect.DeepEqual(codes, []int{http.StatusEarlyHints}) {
+		t.Error(codes)
+	} else if links[0] != "</style.css>; rel=preload; as=style" {
+		t.Error(links[0])
+	}
+	if resp.Header.Get("Link") != links[0] {
+		t.Error(resp.Header.Get("Link"))
+	}
+}
+
+func testExpectContinue(url string, status int, result string, body []byte, t *testing.T) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxConnsPerHost:       1,
+			DisableKeepAlives:     true,
+			ExpectContinueTimeout: time.Minute,
+		},
+		Timeout: time.Second * 10,
+	}
+	if resp, err := client.Do(req); err != nil {
+		t.Error(err)
+	} else if resp.StatusCode != status {
+		t.Error(resp.StatusCode)
+	} else if body, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Error(err)
+	} else if string(body) != result {
+		t.Error(len(body))
+	}
+}
+
 func testMultipart(url string, status int, result string, values map[string]io.Reader, t *testing.T) {
 	var b bytes.Buffer
 	var err error
@@ -183,6 +302,30 @@ func TestResponse(t *testing.T) {
 	m.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 	})
+	m.HandleFunc("/values", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Origin")
+	})
+	m.HandleFunc("/trailer", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("Hello World!\r\n"))
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+	m.HandleFunc("/early", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set(contentType, defaultContentType)
+		w.Write([]byte("Hello World!\r\n"))
+	})
+	m.HandleFunc("/continue", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	m.HandleFunc("/reject", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	})
 	m.HandleFunc("/multipart", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseMultipartForm(1024)
 		mf := r.MultipartForm
@@ -235,6 +378,11 @@ func TestResponse(t *testing.T) {
 	header := make(map[string]string)
 	header["Access-Control-Allow-Origin"] = "*"
 	testHeader("GET", "http://"+addr+"/header", http.StatusOK, "", header, t)
+	testHeaderValues("http://"+addr+"/values", http.Header{"Set-Cookie": {"a=1", "b=2"}, "Vary": {"Accept", "Origin"}}, t)
+	testTrailer("http://"+addr+"/trailer", "Hello World!\r\n", http.Header{"X-Checksum": {"abc"}, "Grpc-Status": {"0"}}, t)
+	testEarlyHints("http://"+addr+"/early", "Hello World!\r\n", t)
+	testExpectContinue("http://"+addr+"/continue", http.StatusOK, string(msg), msg, t)
+	testExpectContinue("http://"+addr+"/reject", http.StatusRequestEntityTooLarge, "", msg, t)
 	values := make(map[string]io.Reader)
 	values["value"] = bytes.NewReader(msg)
 	testMultipart("http://"+addr+"/multipart", http.StatusOK, string(msg), values, t)
@@ -343,3 +491,558 @@ func TestCheckWriteHeaderCode(t *testing.T) {
 	}()
 	checkWriteHeaderCode(0)
 }
+
+func TestWriteHeaderValues(t *testing.T) {
+	h := make(http.Header)
+	h.Add("Set-Cookie", "a=1; Path=/")
+	h.Add("Set-Cookie", "b=2; Path=/")
+	h.Add("Link", "</style.css>; rel=preload")
+	h.Add("Link", "</script.js>; rel=preload")
+	h.Add("Vary", "Accept-Encoding")
+	h.Add("Vary", "Origin")
+	h.Add("X-Empty", "")
+	h.Add("X-Newline", "a\r\nb ")
+	var expect bytes.Buffer
+	if err := h.Write(&expect); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	bw := bufio.NewWriter(&got)
+	writeHeaderValues(bw, h, nil)
+	bw.Flush()
+	if got.String() != expect.String() {
+		t.Errorf("got %q, want %q", got.String(), expect.String())
+	}
+	got.Reset()
+	h.Set(contentType, defaultContentType)
+	h.Set(connection, "close")
+	writeHeaderValues(bw, h, nil)
+	bw.Flush()
+	if got.String() != expect.String() {
+		t.Errorf("got %q, want %q", got.String(), expect.String())
+	}
+}
+
+func TestDeclareTrailer(t *testing.T) {
+	res := &Response{}
+	foreachHeaderElement(" x-checksum , Content-Length,,Expires ", res.declareTrailer)
+	if !reflect.DeepEqual(res.trailers, []string{"X-Checksum", "Expires"}) {
+		t.Error(res.trailers)
+	}
+}
+
+func testServer(handler http.Handler, t *testing.T) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go testServeConn(conn, handler)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func testServeConn(conn net.Conn, handler http.Handler) {
+	reader := NewBufioReader(conn)
+	writer := NewBufioWriter(conn)
+	rw := bufio.NewReadWriter(reader, writer)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			break
+		}
+		res := NewResponse(req, conn, rw)
+		handler.ServeHTTP(res, req)
+		res.FinishRequest()
+		shouldClose := res.ShouldClose()
+		FreeResponse(res)
+		if shouldClose {
+			break
+		}
+	}
+	conn.Close()
+	FreeBufioReader(reader)
+	FreeBufioWriter(writer)
+}
+
+func testRawRequest(reader *bufio.Reader, conn net.Conn, raw string, method string, t *testing.T) (*http.Response, string) {
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func testClosed(reader *bufio.Reader, conn net.Conn, t *testing.T) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Error("connection should be closed", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/close":
+			w.Header().Set("Connection", "close")
+		case "/stream":
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Write([]byte("Hello"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(" World!\r\n"))
+			return
+		}
+		w.Write([]byte("Hello World!\r\n"))
+	}), t)
+	defer stop()
+	cases := []struct {
+		raw        string
+		proto      string
+		connection string
+		close      bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", "HTTP/1.1", "", false},
+		{"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n", "HTTP/1.1", "", true},
+		{"GET /close HTTP/1.1\r\nHost: a\r\n\r\n", "HTTP/1.1", "", true},
+		{"GET /stream HTTP/1.1\r\nHost: a\r\n\r\n", "HTTP/1.1", "", false},
+		{"GET / HTTP/1.0\r\n\r\n", "HTTP/1.0", "", true},
+		{"GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", "HTTP/1.0", "keep-alive", false},
+		{"HEAD / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", "HTTP/1.0", "keep-alive", false},
+		{"GET /stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", "HTTP/1.0", "", true},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		method := c.raw[:strings.IndexByte(c.raw, ' ')]
+		resp, body := testRawRequest(reader, conn, c.raw, method, t)
+		if resp.Proto != c.proto {
+			t.Errorf("%q: Proto %q, want %q", c.raw, resp.Proto, c.proto)
+		}
+		if got := resp.Header.Get("Connection"); got != c.connection {
+			t.Errorf("%q: Connection %q, want %q", c.raw, got, c.connection)
+		}
+		if resp.Close != c.close {
+			t.Errorf("%q: Close %v, want %v", c.raw, resp.Close, c.close)
+		}
+		if len(resp.TransferEncoding) > 0 && resp.ProtoMinor == 0 {
+			t.Errorf("%q: Transfer-Encoding %v", c.raw, resp.TransferEncoding)
+		}
+		if method == "GET" && body != "Hello World!\r\n" {
+			t.Errorf("%q: body %q", c.raw, body)
+		}
+		if c.close {
+			testClosed(reader, conn, t)
+		} else {
+			testRawRequest(reader, conn, c.raw, method, t)
+		}
+		conn.Close()
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	length := 1024 * 64
+	var msg = make([]byte, length)
+	for i := 0; i < length; i++ {
+		msg[i] = byte('a' + i%26)
+	}
+	f, err := ioutil.TempFile("", "response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(msg)
+	f.Close()
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(f.Name())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		var src io.Reader = f
+		switch r.URL.Path {
+		case "/file":
+			w.Header().Set(contentLength, strconv.Itoa(length))
+		case "/limited":
+			w.Header().Set(contentLength, strconv.Itoa(length/2))
+			src = io.LimitReader(f, int64(length/2))
+		case "/over":
+			w.Header().Set(contentLength, strconv.Itoa(length/2))
+		case "/reader":
+			w.Header().Set(contentLength, strconv.Itoa(length))
+			src = bytes.NewReader(msg)
+		}
+		n, err := io.Copy(w, src)
+		if r.URL.Path == "/over" {
+			if err != http.ErrContentLength || n != int64(length/2) {
+				t.Error(n, err)
+			}
+		} else if err != nil {
+			t.Error(err)
+		}
+	}), t)
+	defer stop()
+	testHTTP("GET", "http://"+addr+"/file", http.StatusOK, string(msg), t)
+	testHTTP("GET", "http://"+addr+"/limited", http.StatusOK, string(msg[:length/2]), t)
+	testHTTP("GET", "http://"+addr+"/over", http.StatusOK, string(msg[:length/2]), t)
+	testHTTP("GET", "http://"+addr+"/reader", http.StatusOK, string(msg), t)
+	testHTTP("GET", "http://"+addr+"/chunked", http.StatusOK, string(msg), t)
+}
+
+func TestVectored(t *testing.T) {
+	length := 1024 * 64
+	var msg = make([]byte, length)
+	for i := 0; i < length; i++ {
+		msg[i] = byte('a' + i%26)
+	}
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(*Response).SetVectored(true)
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("Hello World!\r\n"))
+		case "/length":
+			w.Header().Set(contentLength, strconv.Itoa(length))
+			w.Write(msg)
+		case "/chunked":
+			w.Header().Set("Trailer", "X-Checksum")
+			for i := 0; i < length; i += length / 16 {
+				w.Write(msg[i : i+length/16])
+			}
+			w.Header().Set("X-Checksum", "abc")
+		case "/mixed":
+			w.Write(msg[:100])
+			w.(http.Flusher).Flush()
+			w.Write(msg[100:200])
+			w.Write(msg[200:])
+		}
+	}), t)
+	defer stop()
+	testHTTP("GET", "http://"+addr+"/small", http.StatusOK, "Hello World!\r\n", t)
+	testHTTP("GET", "http://"+addr+"/length", http.StatusOK, string(msg), t)
+	testHTTP("GET", "http://"+addr+"/mixed", http.StatusOK, string(msg), t)
+	testTrailer("http://"+addr+"/chunked", string(msg), http.Header{"X-Checksum": {"abc"}}, t)
+}
+
+func benchmarkWrite(b *testing.B, vectored bool, chunked bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := NewBufioReader(conn)
+	writer := NewBufioWriter(conn)
+	rw := bufio.NewReadWriter(reader, writer)
+	req, _ := http.NewRequest("GET", "/", http.NoBody)
+	msg := make([]byte, 1024*16)
+	parts := 4
+	b.SetBytes(int64(len(msg) * parts))
+	b.ReportAllocs()
+	writes, ok := writeSyscalls()
+	defer func() {
+		if n, _ := writeSyscalls(); ok {
+			b.ReportMetric(float64(n-writes)/float64(b.N), "writes/op")
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := NewResponse(req, conn, rw)
+		res.SetVectored(vectored)
+		if !chunked {
+			res.Header().Set(contentLength, strconv.Itoa(len(msg)*parts))
+		}
+		res.Header().Set(contentType, defaultContentType)
+		for j := 0; j < parts; j++ {
+			res.Write(msg)
+		}
+		res.FinishRequest()
+		FreeResponse(res)
+	}
+}
+
+// writeSyscalls returns the number of write syscalls made by the process,
+// which is only known on Linux. A writer wrapping the conn to count its
+// writes would hide writev from net.Buffers, which only uses it on the
+// conns of the net package.
+func writeSyscalls() (n int64, ok bool) {
+	b, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "syscw: ") {
+			n, err = strconv.ParseInt(line[len("syscw: "):], 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrite(b, false, false)
+}
+
+func BenchmarkWriteVectored(b *testing.B) {
+	benchmarkWrite(b, true, false)
+}
+
+func BenchmarkWriteChunked(b *testing.B) {
+	benchmarkWrite(b, false, true)
+}
+
+func BenchmarkWriteChunkedVectored(b *testing.B) {
+	benchmarkWrite(b, true, true)
+}
+
+func TestUnwrap(t *testing.T) {
+	res := &Response{}
+	if Unwrap(res) != res {
+		t.Error("Unwrap(res) != res")
+	}
+	if Unwrap(testUnwrapper{testUnwrapper{res}}) != res {
+		t.Error("Unwrap(wrapper) != res")
+	}
+	if Unwrap(httptest.NewRecorder()) != nil {
+		t.Error("Unwrap(recorder) != nil")
+	}
+}
+
+type testUnwrapper struct {
+	http.ResponseWriter
+}
+
+func (w testUnwrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestDiscardBody(t *testing.T) {
+	addr, stop := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}), t)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	resp, body := testRawRequest(reader, conn, "POST /small HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello", "POST", t)
+	if body != "/small" || resp.Close {
+		t.Errorf("body %q close %v", body, resp.Close)
+	}
+	large := strings.Repeat("a", maxPostHandlerReadBytes*2)
+	go io.WriteString(conn, "POST /large HTTP/1.1\r\nHost: localhost\r\nContent-Length: "+strconv.Itoa(len(large))+"\r\n\r\n"+large)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "/large" || !resp.Close {
+		t.Errorf("body %q close %v", body, resp.Close)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	newResponse := func() *Response {
+		client, conn := net.Pipe()
+		client.Close()
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		req, _ := http.NewRequest("GET", "/", http.NoBody)
+		return NewResponse(req, conn, rw)
+	}
+	res := newResponse()
+	if _, err := res.Write(make([]byte, bufferBeforeChunkingSize*4)); err == nil {
+		t.Fatal("expected a write error")
+	}
+	err := res.Err()
+	if err == nil {
+		t.Fatal("Err returned nil")
+	}
+	if _, e := res.Write([]byte("a")); e != err {
+		t.Errorf("Write returned %v, want %v", e, err)
+	}
+	if e := res.FlushError(); e != err {
+		t.Errorf("FlushError returned %v, want %v", e, err)
+	}
+	if e := res.FinishRequest(); e != err {
+		t.Errorf("FinishRequest returned %v, want %v", e, err)
+	}
+	if !res.ShouldClose() {
+		t.Error("ShouldClose returned false after a write error")
+	}
+	FreeResponse(res)
+
+	res = newResponse()
+	if _, err := res.Write([]byte("buffered")); err != nil {
+		t.Fatal(err)
+	}
+	if res.Err() != nil {
+		t.Fatal("buffered write failed")
+	}
+	if err := res.FinishRequest(); err == nil || err != res.Err() {
+		t.Errorf("FinishRequest returned %v, Err %v", err, res.Err())
+	}
+	FreeResponse(res)
+}
+
+func TestShortBody(t *testing.T) {
+	tests := []struct {
+		method string
+		length string
+		body   string
+		err    error
+	}{
+		{"GET", "1000", "Hello World", ErrShortBody},
+		{"GET", "1000", "", ErrShortBody},
+		{"GET", "11", "Hello World", nil},
+		{"HEAD", "1000", "", nil},
+	}
+	for _, test := range tests {
+		client, conn := net.Pipe()
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		req, _ := http.NewRequest(test.method, "/", http.NoBody)
+		res := NewResponse(req, conn, rw)
+		done := make(chan []byte)
+		go func() {
+			b, _ := ioutil.ReadAll(client)
+			done <- b
+		}()
+		res.Header().Set("Content-Length", test.length)
+		res.Write([]byte(test.body))
+		err := res.FinishRequest()
+		if err != test.err {
+			t.Errorf("%s %s: FinishRequest returned %v, want %v", test.method, test.length, err, test.err)
+		}
+		if res.Err() != err {
+			t.Errorf("%s %s: Err returned %v", test.method, test.length, res.Err())
+		}
+		if res.ShouldClose() != (test.err != nil) {
+			t.Errorf("%s %s: ShouldClose returned %t", test.method, test.length, res.ShouldClose())
+		}
+		FreeResponse(res)
+		conn.Close()
+		if b := <-done; !strings.HasSuffix(string(b), "\r\n\r\n"+test.body) {
+			t.Errorf("%s %s: got %q", test.method, test.length, b)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	var mu sync.Mutex
+	var states []http.ConnState
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "1")
+		conn, rw, err := w.(*Response).Upgrade("echo", http.Header{"X-Extra": {"1"}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if err := r.Context().Err(); err != nil {
+			t.Errorf("context error %v after Upgrade", err)
+		}
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rw.WriteString(line)
+		rw.Flush()
+	})}
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		states = append(states, state)
+		mu.Unlock()
+	}
+	client, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeConn(conn) }()
+	// The protocol's first bytes follow the request.
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: Echo\r\n\r\nHello World\n")
+	b, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	raw := string(b)
+	if !strings.HasPrefix(raw, "HTTP/1.1 101 Switching Protocols\r\n") || !strings.HasSuffix(raw, "\r\n\r\nHello World\n") {
+		t.Errorf("got %q", raw)
+	}
+	for _, line := range []string{"Connection: Upgrade\r\n", "Upgrade: echo\r\n", "X-Extra: 1\r\n", "X-Handler: 1\r\n"} {
+		if !strings.Contains(raw, line) {
+			t.Errorf("missing %q in %q", line, raw)
+		}
+	}
+	for _, key := range []string{"Content-Length", "Transfer-Encoding"} {
+		if strings.Contains(raw, key) {
+			t.Errorf("unexpected %s in %q", key, raw)
+		}
+	}
+	mu.Lock()
+	if len(states) == 0 || states[len(states)-1] != http.StateHijacked {
+		t.Errorf("got states %v", states)
+	}
+	mu.Unlock()
+}
+
+func TestUpgradeError(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		fn   func(w *Response)
+		err  error
+	}{
+		{"not requested", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", nil, ErrUpgrade},
+		{"other protocol", "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n", nil, ErrUpgrade},
+		{"http/1.0", "GET / HTTP/1.0\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", nil, ErrUpgrade},
+		{"header written", "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", func(w *Response) {
+			w.WriteHeader(http.StatusOK)
+		}, ErrHeaderWritten},
+		{"hijacked", "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", func(w *Response) {
+			w.Hijack()
+		}, http.ErrHijacked},
+	}
+	for _, test := range tests {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(test.raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, conn := net.Pipe()
+		client.Close()
+		res := NewResponse(req, conn, nil)
+		if test.fn != nil {
+			test.fn(res)
+		}
+		if _, _, err := res.Upgrade("echo", nil); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		FreeResponse(res)
+	}
+}
@@ -0,0 +1,571 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server serves HTTP/1.x connections with pooled readers, writers and
+// responses.
+type Server struct {
+	// Addr optionally specifies the TCP address for the server to listen on,
+	// in the form "host:port". If empty, ":http" (port 80) is used.
+	Addr string
+
+	// Handler to invoke, http.DefaultServeMux if nil.
+	Handler http.Handler
+
+	// Options configures the responses. MaxHeaderBytes limits the size
+	// of the request line and header read by the server.
+	Options
+
+	// ReadTimeout is the maximum duration for reading the entire
+	// request, including the body. Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// IdleTimeout is the maximum amount of time to wait for the
+	// next request on a keep-alive connection. If zero, the value
+	// of ReadTimeout is used.
+	IdleTimeout time.Duration
+
+	inShutdown atomicBool // true when server is in shutdown
+
+	mu        sync.Mutex
+	listeners map[*net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+}
+
+// contextKey is a value for use with context.WithValue. It's used as
+// a pointer so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "response context value " + k.name }
+
+// ServerContextKey is a context key. It can be used in handlers to
+// access the Server that started the handler. The associated value
+// will be of type *Server. It is not http.ServerContextKey, whose
+// value must be an *http.Server.
+var ServerContextKey = &contextKey{"response-server"}
+
+// serverConn is a connection served by a Server.
+type serverConn struct {
+	server     *Server
+	rwc        net.Conn
+	r          *connReader
+	cancelCtx  context.CancelFunc // cancels the connection-level context
+	remoteAddr string             // rwc.RemoteAddr().String()
+	curState   uint64             // packed (unixtime<<8|uint8(http.ConnState))
+}
+
+func (c *serverConn) setState(state http.ConnState) {
+	packed := uint64(time.Now().Unix()<<8) | uint64(state)
+	if old := atomic.SwapUint64(&c.curState, packed); old != 0 && http.ConnState(old&0xff) == state {
+		return
+	}
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		c.server.trackConn(c, false)
+	}
+	if hook := c.server.ConnState; hook != nil {
+		hook(c.rwc, state)
+	}
+}
+
+func (c *serverConn) getState() (state http.ConnState, unixSec int64) {
+	packed := atomic.LoadUint64(&c.curState)
+	return http.ConnState(packed & 0xff), int64(packed >> 8)
+}
+
+// connReader is the io.Reader under the bufio.Reader of a connection.
+// It limits the bytes read for a request header, and while the handler
+// runs after the request body has been read, it reads in the background
+// to notice when the client goes away.
+type connReader struct {
+	rwc net.Conn // rwc is the underlying network connection.
+
+	mu      sync.Mutex  // guards following
+	conn    *serverConn // conn is nil after handler exit.
+	hasByte bool
+	byteBuf [1]byte
+	cond    *sync.Cond
+	inRead  bool
+	aborted bool  // set true before conn.rwc deadline is set to past
+	remain  int64 // bytes remaining
+}
+
+func (cr *connReader) lock() {
+	cr.mu.Lock()
+	if cr.cond == nil {
+		cr.cond = sync.NewCond(&cr.mu)
+	}
+}
+
+func (cr *connReader) unlock() { cr.mu.Unlock() }
+
+func (cr *connReader) setConn(c *serverConn) {
+	cr.lock()
+	defer cr.unlock()
+	cr.conn = c
+}
+
+func (cr *connReader) startBackgroundRead() {
+	cr.lock()
+	defer cr.unlock()
+	if cr.inRead {
+		panic("invalid concurrent Body.Read call")
+	}
+	if cr.hasByte {
+		return
+	}
+	cr.inRead = true
+	cr.rwc.SetReadDeadline(time.Time{})
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.rwc.Read(cr.byteBuf[:])
+	cr.lock()
+	if n == 1 {
+		// A pipelined request. It doesn't cancel the context.
+		cr.hasByte = true
+	}
+	if ne, ok := err.(net.Error); ok && cr.aborted && ne.Timeout() {
+		// Ignore this error. It's the expected error from
+		// another goroutine calling abortPendingRead.
+	} else if err != nil {
+		cr.handleReadErrorLocked(err)
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.unlock()
+	cr.cond.Broadcast()
+}
+
+func (cr *connReader) abortPendingRead() {
+	cr.lock()
+	defer cr.unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.rwc.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.rwc.SetReadDeadline(time.Time{})
+}
+
+func (cr *connReader) setReadLimit(remain int64) { cr.remain = remain }
+func (cr *connReader) setInfiniteReadLimit()     { cr.remain = maxInt64 }
+func (cr *connReader) hitReadLimit() bool        { return cr.remain <= 0 }
+
+// handleReadErrorLocked is called whenever a Read from the client returns a
+// non-nil error. Any error means the connection is dead, so the context
+// of the request is cancelled.
+//
+// The caller must hold connReader.mu.
+func (cr *connReader) handleReadErrorLocked(_ error) {
+	if cr.conn == nil {
+		return
+	}
+	cr.conn.cancelCtx()
+}
+
+func (cr *connReader) Read(p []byte) (n int, err error) {
+	cr.lock()
+	if cr.inRead {
+		cr.unlock()
+		panic("invalid concurrent Body.Read call")
+	}
+	if cr.hitReadLimit() {
+		cr.unlock()
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		cr.unlock()
+		return 0, nil
+	}
+	if int64(len(p)) > cr.remain {
+		p = p[:cr.remain]
+	}
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.remain--
+		cr.unlock()
+		return 1, nil
+	}
+	cr.inRead = true
+	cr.unlock()
+	n, err = cr.rwc.Read(p)
+
+	cr.lock()
+	cr.inRead = false
+	if err != nil {
+		cr.handleReadErrorLocked(err)
+	}
+	cr.remain -= int64(n)
+	cr.unlock()
+
+	cr.cond.Broadcast()
+	return n, err
+}
+
+// eofSignalBody calls fn once the request body returns io.EOF.
+type eofSignalBody struct {
+	io.ReadCloser
+	fn   func()
+	done bool
+}
+
+func (b *eofSignalBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.fn()
+	}
+	return
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for
+// immediate cancellation of network operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+const maxInt64 = 1<<63 - 1
+
+// errorHeaders is written before the text of an error response to a
+// request that could not be read.
+const errorHeaders = "\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\n\r\n"
+
+// ListenAndServe listens on the TCP network address srv.Addr and then
+// calls Serve to handle requests on incoming connections.
+//
+// ListenAndServe always returns a non-nil error. After Shutdown,
+// the returned error is http.ErrServerClosed.
+func (srv *Server) ListenAndServe() error {
+	if srv.shuttingDown() {
+		return http.ErrServerClosed
+	}
+	addr := srv.Addr
+	if addr == emptyString {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Serve accepts incoming connections on the Listener l, creating a
+// new service goroutine for each. The service goroutines read requests
+// and then call srv.Handler to reply to them.
+//
+// Serve always returns a non-nil error and closes l.
+// After Shutdown, the returned error is http.ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !srv.trackListener(&l, true) {
+		return http.ErrServerClosed
+	}
+	defer srv.trackListener(&l, false)
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		rw, err := l.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return http.ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go srv.ServeConn(rw)
+	}
+}
+
+// ServeConn serves the requests on the connection until the client or
+// a response closes it, or the server shuts down, and then closes it.
+// A connection hijacked by a handler is left to the handler.
+//
+// The context of a request is cancelled when the client's connection
+// closes, when a write to it fails, when the response is finished, or
+// when the handler returns.
+//
+// A request that can't be read is answered with 400 Bad Request, or with
+// 431 Request Header Fields Too Large if its header exceeds
+// MaxHeaderBytes.
+func (srv *Server) ServeConn(rwc net.Conn) error {
+	c := &serverConn{server: srv, rwc: rwc}
+	if ra := rwc.RemoteAddr(); ra != nil {
+		c.remoteAddr = ra.String()
+	}
+	c.r = &connReader{rwc: rwc, conn: c}
+	if !srv.trackConn(c, true) {
+		rwc.Close()
+		return http.ErrServerClosed
+	}
+	c.setState(http.StateNew)
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	reader := NewBufioReader(c.r)
+	writer := NewBufioWriter(rwc)
+	rw := bufio.NewReadWriter(reader, writer)
+	ctx := context.WithValue(context.Background(), ServerContextKey, srv)
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, rwc.LocalAddr())
+	ctx, c.cancelCtx = context.WithCancel(ctx)
+	defer c.cancelCtx()
+	hijacked := false
+	err := c.serve(ctx, handler, rw, &hijacked)
+	if hijacked {
+		return nil
+	}
+	rwc.Close()
+	c.setState(http.StateClosed)
+	FreeBufioReader(reader)
+	FreeBufioWriter(writer)
+	return err
+}
+
+func (c *serverConn) serve(ctx context.Context, handler http.Handler, rw *bufio.ReadWriter, hijacked *bool) error {
+	srv := c.server
+	opts := &srv.Options
+	for {
+		if srv.shuttingDown() {
+			return nil
+		}
+		if d := srv.idleTimeout(); d > 0 {
+			c.rwc.SetReadDeadline(time.Now().Add(d))
+		}
+		c.r.setReadLimit(int64(opts.maxHeaderBytes()) + 4096) // <= bufio slop
+		if _, err := rw.Reader.Peek(1); err != nil {
+			return nil
+		}
+		c.setState(http.StateActive)
+		if d := srv.ReadTimeout; d > 0 {
+			c.rwc.SetReadDeadline(time.Now().Add(d))
+		} else {
+			c.rwc.SetReadDeadline(time.Time{})
+		}
+		req, err := http.ReadRequest(rw.Reader)
+		if err == nil && req.ProtoAtLeast(1, 1) && req.Host == emptyString {
+			err = errMissingHost
+		}
+		if err != nil {
+			return c.replyError(err)
+		}
+		req.RemoteAddr = c.remoteAddr
+		c.r.setInfiniteReadLimit()
+		reqCtx, cancelCtx := context.WithCancel(ctx)
+		req = req.WithContext(reqCtx)
+		// Once the body has been read, read in the background to
+		// notice a client going away.
+		if req.Body == http.NoBody || req.ContentLength == 0 && len(req.TransferEncoding) == 0 {
+			c.r.startBackgroundRead()
+		} else {
+			req.Body = &eofSignalBody{ReadCloser: req.Body, fn: c.r.startBackgroundRead}
+		}
+		res := newResponseWithOptions(req, c.rwc, rw, opts, c)
+		res.cancelCtx = cancelCtx
+		res.Serve(handler)
+		// The handler has returned, so the request is done, even if the
+		// connection has been hijacked.
+		cancelCtx()
+		if res.hijacked.isSet() {
+			FreeResponse(res)
+			*hijacked = true
+			return nil
+		}
+		res.FinishRequest()
+		c.r.abortPendingRead()
+		shouldClose := res.ShouldClose()
+		FreeResponse(res)
+		if shouldClose {
+			return nil
+		}
+	}
+}
+
+var errMissingHost = &badRequestError{"missing required Host header"}
+
+type badRequestError struct{ what string }
+
+func (e *badRequestError) Error() string { return "response: " + e.what }
+
+// hijack stops the background read, so that the connection and its
+// bufio.Reader can be handed to the handler.
+func (c *serverConn) hijack(rw *bufio.ReadWriter) error {
+	c.r.abortPendingRead()
+	c.r.setConn(nil)
+	if c.r.hasByte {
+		if _, err := rw.Reader.Peek(rw.Reader.Buffered() + 1); err != nil {
+			return fmt.Errorf("unexpected Peek failure reading buffered byte: %v", err)
+		}
+	}
+	return nil
+}
+
+// replyError answers a request that could not be read, unless the
+// connection failed, and returns the error.
+func (c *serverConn) replyError(err error) error {
+	var publicErr string
+	if c.r.hitReadLimit() {
+		publicErr = "431 Request Header Fields Too Large"
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return err
+	} else {
+		publicErr = "400 Bad Request"
+	}
+	c.rwc.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(c.rwc, httpVersion+publicErr+errorHeaders+publicErr)
+	return err
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout != 0 {
+		return srv.IdleTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) shuttingDown() bool {
+	return srv.inShutdown.isSet()
+}
+
+// shutdownPollInterval is the longest interval at which Shutdown polls
+// for the connections to become idle.
+const shutdownPollInterval = 500 * time.Millisecond
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active connections. Shutdown works by first closing all open
+// listeners, then closing all idle connections, and then waiting
+// indefinitely for connections to return to idle and then shut down.
+// If the provided context expires before the shutdown is complete,
+// Shutdown returns the context's error, otherwise it returns any
+// error returned from closing the Server's underlying Listener(s).
+//
+// The responses written during the shutdown close their connections.
+// Shutdown does not wait for hijacked connections.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.inShutdown.setTrue()
+	srv.mu.Lock()
+	lnerr := srv.closeListenersLocked()
+	srv.mu.Unlock()
+	interval := time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		if srv.closeIdleConns() {
+			return lnerr
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			if interval *= 2; interval > shutdownPollInterval {
+				interval = shutdownPollInterval
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// closeIdleConns closes all idle connections and reports whether the
+// server is quiescent.
+func (srv *Server) closeIdleConns() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	quiescent := true
+	for c := range srv.conns {
+		st, unixSec := c.getState()
+		// Issue 18447: be conservative and don't close a new connection
+		// until its first request has had a chance to arrive.
+		if st == http.StateNew && unixSec < time.Now().Unix()-5 {
+			st = http.StateIdle
+		}
+		if st != http.StateIdle || unixSec == 0 {
+			// Assume unixSec == 0 means it's a very new
+			// connection, without state set yet.
+			quiescent = false
+			continue
+		}
+		c.rwc.Close()
+		delete(srv.conns, c)
+	}
+	return quiescent
+}
+
+func (srv *Server) closeListenersLocked() error {
+	var err error
+	for ln := range srv.listeners {
+		if cerr := (*ln).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// trackListener adds or removes a net.Listener to the set of tracked
+// listeners. It reports whether the server is still up (not Shutdown).
+func (srv *Server) trackListener(ln *net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.listeners[ln] = struct{}{}
+	} else {
+		delete(srv.listeners, ln)
+	}
+	return true
+}
+
+// trackConn adds or removes a connection to the set of tracked
+// connections. It reports whether the server is still up (not Shutdown).
+func (srv *Server) trackConn(c *serverConn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conns == nil {
+		srv.conns = make(map[*serverConn]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.conns[c] = struct{}{}
+	} else {
+		delete(srv.conns, c)
+	}
+	return true
+}
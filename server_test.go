@@ -0,0 +1,425 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testServe(srv *Server, t *testing.T) (addr string, done chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done = make(chan error, 1)
+	go func() {
+		done <- srv.Serve(ln)
+	}()
+	return ln.Addr().String(), done
+}
+
+func TestServer(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.URL.Path))
+		w.Write(body)
+	})}
+	srv.Server = "response"
+	addr, done := testServe(srv, t)
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post("http://"+addr+"/hello", "text/plain", strings.NewReader(" world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "/hello world" {
+			t.Errorf("body %q", body)
+		}
+		if resp.Header.Get("Server") != "response" {
+			t.Errorf("Server %q", resp.Header.Get("Server"))
+		}
+	}
+	client.CloseIdleConnections()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		t.Errorf("ListenAndServe returned %v", err)
+	}
+}
+
+func TestServerPipelining(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})}
+	addr, _ := testServe(srv, t)
+	defer srv.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	io.WriteString(conn, "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"+
+		"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /c HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != path {
+			t.Errorf("body %q, want %q", body, path)
+		}
+	}
+	testClosed(reader, conn, t)
+}
+
+func TestServerBadRequest(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	srv.MaxHeaderBytes = 1024
+	addr, _ := testServe(srv, t)
+	defer srv.Shutdown(context.Background())
+	tests := []struct {
+		raw  string
+		code int
+	}{
+		{"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", 200},
+		{"GARBAGE\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nBad Header\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nX-Large: " + strings.Repeat("a", 8192) + "\r\n\r\n", 431},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		go io.WriteString(conn, test.raw)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != test.code {
+			t.Errorf("%q: status %d, want %d", test.raw, resp.StatusCode, test.code)
+		}
+		if test.code != 200 {
+			if !resp.Close {
+				t.Errorf("%q: connection should be closed", test.raw)
+			}
+			testClosed(reader, conn, t)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerHijack(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		rw.Flush()
+		conn.Close()
+	})}
+	addr, _ := testServe(srv, t)
+	defer srv.Shutdown(context.Background())
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hijacked" {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestServerRemoteAddr(t *testing.T) {
+	srv := &Server{}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(ServerContextKey) != srv {
+			t.Error("no server in the context")
+		}
+		w.Write([]byte(r.RemoteAddr))
+	})
+	addr, _ := testServe(srv, t)
+	defer srv.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, body := testRawRequest(bufio.NewReader(conn), conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "GET", t)
+	if body != conn.LocalAddr().String() {
+		t.Errorf("RemoteAddr %q, want %q", body, conn.LocalAddr())
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/idle" {
+			return
+		}
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	addr, done := testServe(srv, t)
+	// An idle connection is closed by Shutdown.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idleReader := bufio.NewReader(idle)
+	testRawRequest(idleReader, idle, "GET /idle HTTP/1.1\r\nHost: localhost\r\n\r\n", "GET", t)
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !resp.Close {
+			// The header is written after Shutdown began.
+			result <- "no Connection: close"
+			return
+		}
+		result <- string(body)
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	testClosed(idleReader, idle, t)
+	close(release)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if body := <-result; body != "done" {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestServerConnState(t *testing.T) {
+	var mu sync.Mutex
+	states := make(map[string][]http.ConnState)
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hijack" {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	})}
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		states[conn.RemoteAddr().String()] = append(states[conn.RemoteAddr().String()], state)
+		mu.Unlock()
+	}
+	addr, _ := testServe(srv, t)
+	tests := []struct {
+		raw  []string
+		want []http.ConnState
+	}{
+		{[]string{"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"},
+			[]http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateActive, http.StateClosed}},
+		{[]string{"GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\n"},
+			[]http.ConnState{http.StateNew, http.StateActive, http.StateHijacked}},
+		{[]string{"GARBAGE\r\n\r\n"},
+			[]http.ConnState{http.StateNew, http.StateActive, http.StateClosed}},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		for _, raw := range test.raw {
+			io.WriteString(conn, raw)
+			if resp, err := http.ReadResponse(reader, nil); err == nil {
+				ioutil.ReadAll(resp.Body)
+			}
+		}
+		testClosed(reader, conn, t)
+		conn.Close()
+		key := conn.LocalAddr().String()
+		for i := 0; i < 100; i++ {
+			mu.Lock()
+			n := len(states[key])
+			mu.Unlock()
+			if n >= len(test.want) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		if !reflect.DeepEqual(states[key], test.want) {
+			t.Errorf("%q: states %v, want %v", test.raw, states[key], test.want)
+		}
+		mu.Unlock()
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseConnState(t *testing.T) {
+	var states []http.ConnState
+	opts := &Options{ConnState: func(conn net.Conn, state http.ConnState) {
+		states = append(states, state)
+	}}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go ioutil.ReadAll(client)
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	req, _ := http.NewRequest("GET", "/", http.NoBody)
+	res := NewResponseWithOptions(req, conn, rw, opts)
+	res.FinishRequest()
+	res.FinishRequest()
+	FreeResponse(res)
+	res = NewResponseWithOptions(req, conn, rw, opts)
+	res.Hijack()
+	FreeResponse(res)
+	req.Close = true
+	res = NewResponseWithOptions(req, conn, rw, opts)
+	res.FinishRequest()
+	FreeResponse(res)
+	want := []http.ConnState{http.StateActive, http.StateIdle, http.StateActive, http.StateHijacked, http.StateActive, http.StateClosed}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states %v, want %v", states, want)
+	}
+}
+
+func TestServerContext(t *testing.T) {
+	cancelled := make(chan string, 4)
+	finished := make(chan context.Context, 2)
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/finish":
+			finished <- r.Context()
+			return
+		case "/pipelined":
+			time.Sleep(20 * time.Millisecond)
+			if r.Context().Err() != nil {
+				t.Error("pipelined request cancelled the context")
+			}
+			return
+		case "/body":
+			ioutil.ReadAll(r.Body)
+		}
+		select {
+		case <-r.Context().Done():
+			cancelled <- r.URL.Path
+		case <-time.After(time.Second):
+			cancelled <- "timeout"
+		}
+	})}
+	addr, _ := testServe(srv, t)
+	defer srv.Shutdown(context.Background())
+	for _, raw := range []string{
+		"GET /gone HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		"POST /body HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, raw)
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+		if path := <-cancelled; path == "timeout" {
+			t.Errorf("%q: context not cancelled", raw)
+		}
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	testRawRequest(reader, conn, "GET /finish HTTP/1.1\r\nHost: localhost\r\n\r\n", "GET", t)
+	if err := (<-finished).Err(); err != context.Canceled {
+		t.Errorf("context error %v after FinishRequest", err)
+	}
+	io.WriteString(conn, "GET /pipelined HTTP/1.1\r\nHost: localhost\r\n\r\nGET /finish HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	for i := 0; i < 2; i++ {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+	}
+}
+
+func TestServerHijackContext(t *testing.T) {
+	hijacked := make(chan context.Context, 1)
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if err := r.Context().Err(); err != nil {
+			t.Errorf("context error %v after Hijack", err)
+		}
+		hijacked <- r.Context()
+	})}
+	client, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeConn(conn) }()
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	ioutil.ReadAll(client)
+	<-done
+	if err := (<-hijacked).Err(); err != context.Canceled {
+		t.Errorf("context error %v after the handler returned", err)
+	}
+}
+
+func TestWriteErrorCancel(t *testing.T) {
+	client, conn := net.Pipe()
+	client.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	req, _ := http.NewRequest("GET", "/", http.NoBody)
+	ctx, cancel := context.WithCancel(context.Background())
+	res := NewResponse(req, conn, rw)
+	res.cancelCtx = cancel
+	res.Write(make([]byte, bufferBeforeChunkingSize*4))
+	if ctx.Err() != context.Canceled {
+		t.Errorf("context error %v after a write error", ctx.Err())
+	}
+	res.FinishRequest()
+	FreeResponse(res)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventStreamType = "text/event-stream"
+	cacheControl    = "Cache-Control"
+	lastEventID     = "Last-Event-ID"
+)
+
+// heartbeatComment is an empty comment, which the client ignores.
+var heartbeatComment = []byte(":\n\n")
+
+var (
+	// ErrInvalidEvent is returned by Send when the ID or the type of the
+	// event contains a line break, or the ID contains a NUL.
+	ErrInvalidEvent = errors.New("response: invalid event")
+
+	// ErrEventStreamClosed is returned by Send after Close.
+	ErrEventStreamClosed = errors.New("response: event stream closed")
+)
+
+// Event is a server-sent event. See the HTML Living Standard, section
+// 9.2, Server-sent events.
+type Event struct {
+	// ID sets the last event ID, which the client sends back in the
+	// Last-Event-ID header when it reconnects. Empty means no id field.
+	ID string
+
+	// Event is the type of the event. Empty means a "message" event.
+	Event string
+
+	// Data is the data of the event. Each of its lines is sent as a
+	// data field, whether it ends with LF, CRLF or CR.
+	Data string
+
+	// Retry sets the time the client waits before reconnecting. Zero
+	// means no retry field.
+	Retry time.Duration
+}
+
+// EventStream writes server-sent events to a response.
+//
+// Each event is sent as one chunk and flushed at once. The methods of an
+// EventStream may be called concurrently, but the response must not be
+// written to directly while the stream is open.
+type EventStream struct {
+	w      *Response
+	mu     sync.Mutex
+	buf    []byte
+	err    error
+	done   chan struct{}
+	stop   chan struct{}
+	exited chan struct{}
+	once   sync.Once
+}
+
+// NewEventStream writes the header of a text/event-stream response, which
+// is neither buffered, sniffed, compressed nor given an ETag, and returns
+// the stream of its events.
+//
+// If heartbeat is positive, an empty comment is sent at that interval to
+// keep proxies from closing an idle connection.
+//
+// The stream ends when the request's context is done, as it is when a
+// Server notices that the client went away, or when a write fails. It is
+// closed when the response finishes, if the handler hasn't closed it, so
+// that the heartbeat never writes to a finished response.
+func NewEventStream(w *Response, heartbeat time.Duration) (*EventStream, error) {
+	h := w.Header()
+	h.Set(contentType, eventStreamType)
+	h.Set(cacheControl, "no-cache")
+	h.Del(contentLength)
+	w.SetCompression(false)
+	w.SetETag(false)
+	w.WriteHeader(http.StatusOK)
+	if err := w.FlushError(); err != nil {
+		return nil, err
+	}
+	es := &EventStream{
+		w:      w,
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	w.onFinish(es.Close)
+	go es.run(heartbeat)
+	return es, nil
+}
+
+// LastEventID returns the Last-Event-ID header of the request, which is
+// the ID of the last event a reconnecting client received.
+func (es *EventStream) LastEventID() string {
+	return es.w.req.Header.Get(lastEventID)
+}
+
+// Done returns a channel that is closed when the stream ends because the
+// request's context is done or a write failed.
+func (es *EventStream) Done() <-chan struct{} {
+	return es.done
+}
+
+// Send writes the event and flushes it to the client.
+func (es *EventStream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidEvent
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.buf = appendEvent(es.buf[:0], e)
+	return es.write(es.buf)
+}
+
+// Comment writes each line of the text as a comment, which the client
+// ignores, and flushes it to the client.
+func (es *EventStream) Comment(text string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.buf = appendField(es.buf[:0], emptyString, text)
+	es.buf = append(es.buf, '\n')
+	return es.write(es.buf)
+}
+
+// Close stops the heartbeat. Later sends return ErrEventStreamClosed.
+func (es *EventStream) Close() {
+	es.mu.Lock()
+	if es.err == nil {
+		es.err = ErrEventStreamClosed
+	}
+	es.mu.Unlock()
+	es.once.Do(func() { close(es.stop) })
+	<-es.exited
+}
+
+// write writes p as one chunk and flushes it. The caller holds mu.
+func (es *EventStream) write(p []byte) error {
+	if es.err != nil {
+		return es.err
+	}
+	_, err := es.w.Write(p)
+	if err == nil {
+		err = es.w.FlushError()
+	}
+	if err != nil {
+		es.end(err)
+	}
+	return err
+}
+
+// end records the error that ended the stream. The caller holds mu.
+func (es *EventStream) end(err error) {
+	if es.err == nil {
+		es.err = err
+		close(es.done)
+	}
+}
+
+// run sends the heartbeats and ends the stream when the request's context
+// is done, until Close is called.
+func (es *EventStream) run(heartbeat time.Duration) {
+	defer close(es.exited)
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	ctx := es.w.req.Context()
+	for {
+		select {
+		case <-tick:
+			es.mu.Lock()
+			es.write(heartbeatComment)
+			es.mu.Unlock()
+		case <-ctx.Done():
+			es.mu.Lock()
+			es.end(ctx.Err())
+			es.mu.Unlock()
+			return
+		case <-es.done:
+			return
+		case <-es.stop:
+			return
+		}
+	}
+}
+
+// appendEvent appends the fields of the event, ended by a blank line.
+func appendEvent(b []byte, e Event) []byte {
+	if e.ID != emptyString {
+		b = appendField(b, "id", e.ID)
+	}
+	if e.Event != emptyString {
+		b = appendField(b, "event", e.Event)
+	}
+	if e.Data != emptyString {
+		b = appendField(b, "data", e.Data)
+	}
+	if e.Retry > 0 {
+		b = append(b, "retry: "...)
+		b = strconv.AppendInt(b, int64(e.Retry/time.Millisecond), 10)
+		b = append(b, '\n')
+	}
+	return append(b, '\n')
+}
+
+// appendField appends one field for each line of the value. An empty
+// name appends comments.
+func appendField(b []byte, name, value string) []byte {
+	for {
+		i := strings.IndexAny(value, "\r\n")
+		line := value
+		if i >= 0 {
+			line = value[:i]
+		}
+		b = append(b, name...)
+		b = append(b, ':', ' ')
+		b = append(b, line...)
+		b = append(b, '\n')
+		if i < 0 {
+			return b
+		}
+		if value[i] == '\r' && i+1 < len(value) && value[i+1] == '\n' {
+			i++
+		}
+		value = value[i+1:]
+	}
+}
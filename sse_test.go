@@ -0,0 +1,146 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	const get = "GET /events HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\nLast-Event-ID: 41\r\nConnection: close\r\n\r\n"
+	var lastID string
+	var sendErr, invalidErr, closedErr error
+	raw := testOptions(&Options{Compression: true, ETag: true}, get, func(w http.ResponseWriter, r *http.Request) {
+		es, err := NewEventStream(w.(*Response), 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		lastID = es.LastEventID()
+		sendErr = es.Send(Event{ID: "42", Event: "update", Data: "line 1\nline 2\r\nline 3\rline 4\n", Retry: 3 * time.Second})
+		es.Send(Event{Data: "Hello World"})
+		es.Comment("note\nmore")
+		invalidErr = es.Send(Event{ID: "4\n2"})
+		es.Close()
+		closedErr = es.Send(Event{Data: "closed"})
+	}, t)
+	if sendErr != nil || invalidErr != ErrInvalidEvent || closedErr != ErrEventStreamClosed {
+		t.Errorf("got errors %v, %v, %v", sendErr, invalidErr, closedErr)
+	}
+	if lastID != "41" {
+		t.Errorf("got Last-Event-ID %q", lastID)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("got Cache-Control %q", cc)
+	}
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Etag") != "" {
+		t.Errorf("got header %v", res.Header)
+	}
+	if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+		t.Errorf("got Transfer-Encoding %v", res.TransferEncoding)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	want := "id: 42\nevent: update\n" +
+		"data: line 1\ndata: line 2\ndata: line 3\ndata: line 4\ndata: \n" +
+		"retry: 3000\n\n" +
+		"data: Hello World\n\n" +
+		": note\n: more\n\n"
+	if string(body) != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+}
+
+func TestEventStreamHeartbeat(t *testing.T) {
+	const get = "GET /events HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	raw := testOptions(nil, get, func(w http.ResponseWriter, r *http.Request) {
+		es, err := NewEventStream(w.(*Response), 5*time.Millisecond)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		time.Sleep(30 * time.Millisecond)
+		es.Close()
+	}, t)
+	if !strings.Contains(raw, "\r\n:\n\n\r\n") {
+		t.Errorf("no heartbeat in %q", raw)
+	}
+}
+
+func TestEventStreamDisconnect(t *testing.T) {
+	ended := make(chan error, 1)
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		es, err := NewEventStream(w.(*Response), time.Millisecond)
+		if err != nil {
+			ended <- err
+			return
+		}
+		defer es.Close()
+		<-es.Done()
+		ended <- es.Send(Event{Data: "gone"})
+	})}
+	client, conn := net.Pipe()
+	go srv.ServeConn(conn)
+	go io.WriteString(client, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	br := bufio.NewReader(client)
+	if _, err := http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	select {
+	case err := <-ended:
+		if err == nil {
+			t.Error("Send succeeded after the client went away")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream did not end after the client went away")
+	}
+}
+
+func TestEventStreamFinish(t *testing.T) {
+	const get = "GET /events HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	streams := make(chan *EventStream, 1)
+	// The handler returns without closing the stream.
+	raw := testOptions(nil, get, func(w http.ResponseWriter, r *http.Request) {
+		es, err := NewEventStream(w.(*Response), time.Millisecond)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		streams <- es
+		time.Sleep(10 * time.Millisecond)
+	}, t)
+	if !strings.HasSuffix(raw, "\r\n0\r\n\r\n") {
+		t.Errorf("got %q", raw)
+	}
+	if err := (<-streams).Send(Event{Data: "finished"}); err != ErrEventStreamClosed {
+		t.Errorf("Send returned %v after the response finished", err)
+	}
+	// The handler panics.
+	raw, err := testServeOptions(&Options{ErrorLog: log.New(ioutil.Discard, "", 0)}, get, func(w http.ResponseWriter, r *http.Request) {
+		if _, err := NewEventStream(w.(*Response), time.Millisecond); err != nil {
+			t.Error(err)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		panic("boom")
+	}, t)
+	if err != http.ErrAbortHandler || strings.HasSuffix(raw, "\r\n0\r\n\r\n") {
+		t.Errorf("got %v, %q", err, raw)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// HeaderPolicy selects what is done with a header field whose name is not
+// a token or whose value contains CR, LF, NUL or another control byte,
+// which would let the field split the response. See RFC 7230, section 3.2.
+type HeaderPolicy int
+
+const (
+	// HeaderReplace replaces the control bytes of a value with spaces, as
+	// http.Header.Write does, and drops a field whose name is not valid.
+	HeaderReplace HeaderPolicy = iota
+	// HeaderDrop drops the value, or the field if its name is not valid.
+	HeaderDrop
+	// HeaderFail fails the response. Its header is replaced with a 500
+	// Internal Server Error without a body, the connection is closed and
+	// ErrInvalidHeader is returned by Write, Err and FinishRequest. Since
+	// trailers follow the header, an invalid trailer is dropped.
+	HeaderFail
+)
+
+// ErrInvalidHeader is the error of a response failed by the HeaderFail
+// policy.
+var ErrInvalidHeader = errors.New("response: invalid header field")
+
+// validHeaderFieldName reports whether v is a token.
+func validHeaderFieldName(v string) bool {
+	if len(v) == 0 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if !isTokenByte(v[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenByte reports whether b is a tchar. See RFC 7230, section 3.2.6.
+func isTokenByte(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", b) >= 0
+}
+
+// validHeaderFieldValue reports whether v has no control bytes other
+// than the horizontal tab.
+func validHeaderFieldValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if isCTL(v[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isCTL(b byte) bool {
+	const del = 0x7f
+	return b < ' ' && b != '\t' || b == del
+}
+
+// replaceCTL returns v with its control bytes replaced with spaces.
+func replaceCTL(v string) string {
+	b := []byte(v)
+	for i, c := range b {
+		if isCTL(c) {
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
+
+// cleanValues applies the policy to the values of a field, reusing the
+// slice, and reports whether they were all valid.
+func cleanValues(values []string, policy HeaderPolicy) ([]string, bool) {
+	valid := true
+	n := 0
+	for _, v := range values {
+		if !validHeaderFieldValue(v) {
+			valid = false
+			if policy != HeaderReplace {
+				continue
+			}
+			v = replaceCTL(v)
+		}
+		values[n] = v
+		n++
+	}
+	for i := n; i < len(values); i++ {
+		values[i] = emptyString
+	}
+	return values[:n], valid
+}
+
+// cleanHeader applies the policy to the fields of h in place. Under
+// HeaderFail it leaves h as it is and returns ErrInvalidHeader if a field
+// is not valid.
+func cleanHeader(h http.Header, policy HeaderPolicy) error {
+	for key, values := range h {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			// Trailers are cleaned when they are written.
+			continue
+		}
+		if !validHeaderFieldName(key) {
+			if policy == HeaderFail {
+				return ErrInvalidHeader
+			}
+			delete(h, key)
+			continue
+		}
+		for _, v := range values {
+			if validHeaderFieldValue(v) {
+				continue
+			}
+			if policy == HeaderFail {
+				return ErrInvalidHeader
+			}
+			if values, _ = cleanValues(values, policy); len(values) > 0 {
+				h[key] = values
+			} else {
+				delete(h, key)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// failHeader replaces the response with a 500 Internal Server Error
+// without a body, and closes the connection after it.
+func (cw *chunkWriter) failHeader(err error) {
+	w := cw.res
+	if w.err == nil {
+		w.err = err
+	}
+	for key := range w.handlerHeader {
+		delete(w.handlerHeader, key)
+	}
+	w.status = http.StatusInternalServerError
+	w.closeAfterReply = true
+	w.setHeader.contentType = emptyString
+	w.setHeader.transferEncoding = emptyString
+	w.setHeader.contentLength = emptyString
+	cw.chunking = false
+	cw.discard = true
+	w.setContentLength(0)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package response
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func FuzzHeaderPolicy(f *testing.F) {
+	for _, seed := range []struct{ key, value string }{
+		{"X-Test", "ok"},
+		{"X-Test", "a\r\nSet-Cookie: b"},
+		{"X-Test\r\nSet-Cookie", "a"},
+		{"X-Test", "a\x00b"},
+		{"Content-Type", "text/html\r\n\r\n<script>"},
+		{"Connection", "keep-alive\nX: y"},
+		{"Date", "\r\n"},
+	} {
+		f.Add(seed.key, seed.value)
+	}
+	f.Fuzz(func(t *testing.T, key, value string) {
+		switch strings.ToLower(key) {
+		case "", "content-length", "transfer-encoding", "trailer":
+			// These frame the body.
+			t.Skip()
+		}
+		for _, policy := range []HeaderPolicy{HeaderReplace, HeaderDrop, HeaderFail} {
+			resp, body, rest := testValidate(policy, key, value, t)
+			if rest != "" {
+				t.Fatalf("%d %q: %q: split the response: %q", policy, key, value, rest)
+			}
+			if resp.StatusCode == 500 {
+				if policy != HeaderFail || body != "" {
+					t.Fatalf("%d %q: %q: status %d body %q", policy, key, value, resp.StatusCode, body)
+				}
+				continue
+			}
+			if resp.StatusCode != 200 {
+				t.Fatalf("%d %q: %q: status %d", policy, key, value, resp.StatusCode)
+			}
+			for _, h := range []http.Header{resp.Header, resp.Trailer} {
+				for k, values := range h {
+					if !validHeaderFieldName(k) {
+						t.Fatalf("%d %q: %q: invalid name %q", policy, key, value, k)
+					}
+					for _, v := range values {
+						if !validHeaderFieldValue(v) {
+							t.Fatalf("%d %q: %q: invalid value %q", policy, key, value, v)
+						}
+					}
+				}
+			}
+			valid := validHeaderFieldName(key) && validHeaderFieldValue(value)
+			if policy == HeaderFail && !valid {
+				t.Fatalf("%d %q: %q: not failed", policy, key, value)
+			}
+			if body != "body" {
+				t.Fatalf("%d %q: %q: body %q", policy, key, value, body)
+			}
+		}
+	})
+}
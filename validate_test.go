@@ -0,0 +1,137 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package response
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testValidateRequest = "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+
+// testValidate writes a response with the header field through the
+// policy, and reads it back.
+func testValidate(policy HeaderPolicy, key, value string, t *testing.T) (*http.Response, string, string) {
+	raw := testOptions(&Options{HeaderPolicy: policy}, testValidateRequest, func(w http.ResponseWriter, r *http.Request) {
+		w.Header()[key] = []string{value}
+		w.Header().Set("Trailer", "X-Trailer")
+		w.Write([]byte("body"))
+		w.(*Response).Flush()
+		w.Header().Set("X-Trailer", value)
+		w.Header()[http.TrailerPrefix+key] = []string{value}
+	}, t)
+	reader := bufio.NewReader(strings.NewReader(raw))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("%q: %v", raw, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%q: %v", raw, err)
+	}
+	rest, _ := ioutil.ReadAll(reader)
+	return resp, string(body), string(rest)
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	tests := []struct {
+		policy HeaderPolicy
+		key    string
+		value  string
+		status int
+		values []string
+	}{
+		{HeaderReplace, "X-Test", "ok", 200, []string{"ok"}},
+		{HeaderReplace, "X-Test", "a\r\nSet-Cookie: b", 200, []string{"a  Set-Cookie: b"}},
+		{HeaderReplace, "X-Test", "a\x00b\x7fc\td", 200, []string{"a b c\td"}},
+		{HeaderReplace, "X-Test\r\nSet-Cookie", "a", 200, nil},
+		{HeaderReplace, "X Test", "a", 200, nil},
+		{HeaderDrop, "X-Test", "ok", 200, []string{"ok"}},
+		{HeaderDrop, "X-Test", "a\r\nSet-Cookie: b", 200, nil},
+		{HeaderDrop, "X-Test:", "a", 200, nil},
+		{HeaderFail, "X-Test", "ok", 200, []string{"ok"}},
+		{HeaderFail, "X-Test", "a\nSet-Cookie: b", 500, nil},
+		{HeaderFail, "X(Test)", "a", 500, nil},
+	}
+	for _, test := range tests {
+		resp, body, rest := testValidate(test.policy, test.key, test.value, t)
+		if resp.StatusCode != test.status {
+			t.Errorf("%d %q: %q: status %d, want %d", test.policy, test.key, test.value, resp.StatusCode, test.status)
+		}
+		if resp.Header.Get("Set-Cookie") != "" || resp.Trailer.Get("Set-Cookie") != "" || rest != "" {
+			t.Errorf("%d %q: %q: split the response", test.policy, test.key, test.value)
+		}
+		if got := resp.Header[http.CanonicalHeaderKey(test.key)]; !reflect.DeepEqual(got, test.values) {
+			t.Errorf("%d %q: %q: values %q, want %q", test.policy, test.key, test.value, got, test.values)
+		}
+		if test.status == 500 {
+			if body != "" {
+				t.Errorf("%d %q: %q: body %q", test.policy, test.key, test.value, body)
+			}
+			continue
+		}
+		if body != "body" {
+			t.Errorf("%d %q: %q: body %q", test.policy, test.key, test.value, body)
+		}
+		want := []string{test.value}
+		if !validHeaderFieldValue(test.value) {
+			want = nil
+			if test.policy == HeaderReplace {
+				want = []string{strings.TrimSpace(replaceCTL(test.value))}
+			}
+		}
+		if got := resp.Trailer["X-Trailer"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d %q: %q: trailer %q, want %q", test.policy, test.key, test.value, got, want)
+		}
+	}
+}
+
+func TestHeaderFail(t *testing.T) {
+	raw := testOptions(&Options{HeaderPolicy: HeaderFail}, testValidateRequest, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html\r\nX-Injected: 1")
+		w.Header().Set("X-Other", "ok")
+		if _, err := w.Write([]byte("body")); err != nil {
+			t.Error(err)
+		}
+		res := w.(*Response)
+		res.Flush()
+		if _, err := w.Write([]byte("more")); err != ErrInvalidHeader {
+			t.Errorf("Write returned %v", err)
+		}
+		if res.Err() != ErrInvalidHeader || !res.ShouldClose() {
+			t.Errorf("Err %v ShouldClose %v", res.Err(), res.ShouldClose())
+		}
+	}, t)
+	want := "HTTP/1.1 500 Internal Server Error\r\n"
+	if !strings.HasPrefix(raw, want) || !strings.HasSuffix(raw, "Content-Length: 0\r\nConnection: close\r\n\r\n") || strings.Contains(raw, "X-") {
+		t.Errorf("%q", raw)
+	}
+}
+
+func TestValidHeaderField(t *testing.T) {
+	for _, name := range []string{"X-Test", "x_test", "!#$%&'*+-.^_`|~09AZaz"} {
+		if !validHeaderFieldName(name) {
+			t.Errorf("%q should be valid", name)
+		}
+	}
+	for _, name := range []string{"", "X Test", "X:Test", "X\r\nTest", "X\x00", "Ä", "(x)"} {
+		if validHeaderFieldName(name) {
+			t.Errorf("%q should not be valid", name)
+		}
+	}
+	for _, value := range []string{"", "a b\tc", "\x80\xff", "é"} {
+		if !validHeaderFieldValue(value) {
+			t.Errorf("%q should be valid", value)
+		}
+	}
+	for _, value := range []string{"\r", "\n", "\x00", "\x7f", "\x1f"} {
+		if validHeaderFieldValue(value) {
+			t.Errorf("%q should not be valid", value)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a data message.
+type MessageType int
+
+// The message types are the opcodes of their frames.
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Opcodes. See RFC 6455, section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	// maxControlPayload is the largest payload of a control frame.
+	maxControlPayload = 125
+)
+
+// Close codes. See RFC 6455, section 7.4.1.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseInternalServerErr       = 1011
+)
+
+var (
+	// ErrCloseSent is returned by the write methods after a close frame
+	// has been sent.
+	ErrCloseSent = errors.New("websocket: close sent")
+
+	// ErrMessageType is returned by WriteMessage for a type other than
+	// TextMessage and BinaryMessage.
+	ErrMessageType = errors.New("websocket: invalid message type")
+
+	// ErrControlTooLong is returned when the payload of a ping or a close
+	// frame is longer than 125 bytes.
+	ErrControlTooLong = errors.New("websocket: control frame too long")
+)
+
+// CloseError is returned by ReadMessage when the connection is closed,
+// by the client or because the client broke the protocol.
+type CloseError struct {
+	// Code is the close code, or CloseNoStatusReceived if the client
+	// sent none.
+	Code int
+	// Text is the reason sent with the code.
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return "websocket: close " + strconv.Itoa(e.Code) + " " + e.Text
+}
+
+// Conn is a server WebSocket connection.
+//
+// One goroutine may read while another writes. Ping and WriteClose may
+// be called concurrently with the other methods.
+type Conn struct {
+	conn        net.Conn
+	rw          *bufio.ReadWriter
+	subprotocol string
+	readLimit   int64
+	readErr     error
+	hdr         [14]byte // frame header scratch, read side
+	pongHandler func(appData []byte)
+
+	mu        sync.Mutex // guards the writes
+	wbuf      [10]byte   // frame header scratch, write side
+	closeSent bool
+}
+
+func newConn(conn net.Conn, rw *bufio.ReadWriter, subprotocol string, readLimit int64) *Conn {
+	return &Conn{conn: conn, rw: rw, subprotocol: subprotocol, readLimit: readLimit}
+}
+
+// Subprotocol returns the subprotocol selected by Upgrade, or an empty
+// string.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline for reads on the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes on the connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets the function called by ReadMessage with the payload
+// of each pong frame. Pongs are ignored by default.
+func (c *Conn) SetPongHandler(h func(appData []byte)) {
+	c.pongHandler = h
+}
+
+// WriteMessage writes a text or binary message as a single frame.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrMessageType
+	}
+	return c.writeFrame(byte(messageType), data)
+}
+
+// Ping writes a ping frame, to which the client replies with a pong
+// carrying the same payload.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return ErrControlTooLong
+	}
+	return c.writeFrame(opPing, data)
+}
+
+// WriteClose writes a close frame with the code and the reason. No other
+// frame may be written after it.
+func (c *Conn) WriteClose(code int, reason string) error {
+	if len(reason)+2 > maxControlPayload {
+		return ErrControlTooLong
+	}
+	return c.writeFrame(opClose, closePayload(code, reason))
+}
+
+// Close sends a normal closure, unless a close frame has been sent
+// already, and closes the connection without waiting for the client's
+// close frame.
+func (c *Conn) Close() error {
+	err := c.WriteClose(CloseNormalClosure, "")
+	if err == ErrCloseSent {
+		err = nil
+	}
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFrame writes a final, unmasked frame and flushes it.
+func (c *Conn) writeFrame(opcode byte, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	b := c.wbuf[:2]
+	b[0] = finBit | opcode
+	switch n := len(data); {
+	case n <= maxControlPayload:
+		b[1] = byte(n)
+	case n <= 0xffff:
+		b[1] = 126
+		b = b[:4]
+		binary.BigEndian.PutUint16(b[2:], uint16(n))
+	default:
+		b[1] = 127
+		b = b[:10]
+		binary.BigEndian.PutUint64(b[2:], uint64(n))
+	}
+	c.rw.Write(b)
+	c.rw.Write(data)
+	return c.rw.Flush()
+}
+
+// frameHeader is the header of a frame read from the client.
+type frameHeader struct {
+	fin    bool
+	opcode byte
+	length int64
+	mask   [4]byte
+}
+
+// ReadMessage reads the next text or binary message, joining its
+// fragments. Ping frames are answered with pongs, and pong frames are
+// passed to the pong handler.
+//
+// When the client sends a close frame, ReadMessage echoes it, closes the
+// connection and returns a *CloseError. If the client breaks the
+// protocol, ReadMessage closes the connection with the matching close
+// code and returns a *CloseError too. Once ReadMessage has returned an
+// error, it returns the same error.
+func (c *Conn) ReadMessage() (messageType MessageType, p []byte, err error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	for {
+		h, err := c.readFrameHeader()
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		if h.opcode >= opClose {
+			if err := c.readControl(h); err != nil {
+				return 0, nil, c.fail(err)
+			}
+			continue
+		}
+		switch h.opcode {
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(protocolError("continuation frame without a message"))
+			}
+		case opText, opBinary:
+			if messageType != 0 {
+				return 0, nil, c.fail(protocolError("data frame inside a fragmented message"))
+			}
+			messageType = MessageType(h.opcode)
+		default:
+			return 0, nil, c.fail(protocolError("unknown opcode " + strconv.Itoa(int(h.opcode))))
+		}
+		if h.length > c.readLimit-int64(len(p)) {
+			return 0, nil, c.fail(&CloseError{Code: CloseMessageTooBig, Text: "message too big"})
+		}
+		n := len(p)
+		p = append(p, make([]byte, h.length)...)
+		if err := c.readPayload(h, p[n:]); err != nil {
+			return 0, nil, c.fail(err)
+		}
+		if h.fin {
+			if messageType == TextMessage && !utf8.Valid(p) {
+				return 0, nil, c.fail(&CloseError{Code: CloseInvalidFramePayloadData, Text: "invalid UTF-8"})
+			}
+			return messageType, p, nil
+		}
+	}
+}
+
+// readFrameHeader reads the header of the next frame, which a client must
+// mask. See RFC 6455, section 5.2.
+func (c *Conn) readFrameHeader() (h frameHeader, err error) {
+	b := c.hdr[:2]
+	if _, err = io.ReadFull(c.rw, b); err != nil {
+		return
+	}
+	if b[0]&rsvBits != 0 {
+		return h, protocolError("reserved bits set")
+	}
+	if b[1]&maskBit == 0 {
+		return h, protocolError("frame not masked")
+	}
+	h.fin = b[0]&finBit != 0
+	h.opcode = b[0] & 0xf
+	h.length = int64(b[1] &^ maskBit)
+	switch h.length {
+	case 126:
+		b = c.hdr[:2]
+		if _, err = io.ReadFull(c.rw, b); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint16(b))
+	case 127:
+		b = c.hdr[:8]
+		if _, err = io.ReadFull(c.rw, b); err != nil {
+			return
+		}
+		if b[0]&0x80 != 0 {
+			return h, protocolError("frame length overflow")
+		}
+		h.length = int64(binary.BigEndian.Uint64(b))
+	}
+	if _, err = io.ReadFull(c.rw, h.mask[:]); err != nil {
+		return
+	}
+	if h.opcode >= opClose && (!h.fin || h.length > maxControlPayload) {
+		return h, protocolError("invalid control frame")
+	}
+	return h, nil
+}
+
+// readPayload reads the payload of the frame into p and unmasks it.
+func (c *Conn) readPayload(h frameHeader, p []byte) error {
+	if _, err := io.ReadFull(c.rw, p); err != nil {
+		return err
+	}
+	for i := range p {
+		p[i] ^= h.mask[i&3]
+	}
+	return nil
+}
+
+// readControl handles a control frame.
+func (c *Conn) readControl(h frameHeader) error {
+	var buf [maxControlPayload]byte
+	p := buf[:h.length]
+	if err := c.readPayload(h, p); err != nil {
+		return err
+	}
+	switch h.opcode {
+	case opPing:
+		if err := c.writeFrame(opPong, p); err != nil && err != ErrCloseSent {
+			return err
+		}
+	case opPong:
+		if c.pongHandler != nil {
+			c.pongHandler(p)
+		}
+	case opClose:
+		e := &CloseError{Code: CloseNoStatusReceived}
+		if len(p) > 0 {
+			if len(p) < 2 {
+				return protocolError("invalid close payload")
+			}
+			e.Code = int(binary.BigEndian.Uint16(p))
+			e.Text = string(p[2:])
+			if !validCloseCode(e.Code) {
+				return protocolError("invalid close code")
+			}
+			if !utf8.ValidString(e.Text) {
+				return &CloseError{Code: CloseInvalidFramePayloadData, Text: "invalid UTF-8"}
+			}
+		}
+		// Echo the status code. See RFC 6455, section 5.5.1.
+		echo := closePayload(e.Code, "")
+		if len(p) == 0 {
+			echo = nil
+		}
+		c.writeFrame(opClose, echo)
+		c.conn.Close()
+		c.readErr = e
+		return e
+	default:
+		return protocolError("unknown opcode " + strconv.Itoa(int(h.opcode)))
+	}
+	return nil
+}
+
+// fail records the error that ended the reads. If the client broke the
+// protocol, the connection is closed with the close code of the error.
+// A connection closed without a close frame is reported as an abnormal
+// closure.
+func (c *Conn) fail(err error) error {
+	if c.readErr != nil {
+		return c.readErr
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = &CloseError{Code: CloseAbnormalClosure, Text: err.Error()}
+	} else if e, ok := err.(*CloseError); ok {
+		c.WriteClose(e.Code, e.Text)
+		c.conn.Close()
+	}
+	c.readErr = err
+	return err
+}
+
+func protocolError(text string) *CloseError {
+	return &CloseError{Code: CloseProtocolError, Text: text}
+}
+
+// closePayload returns the payload of a close frame.
+func closePayload(code int, reason string) []byte {
+	p := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	return append(p, reason...)
+}
+
+// validCloseCode reports whether the code may be received in a close
+// frame. See RFC 6455, section 7.4.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
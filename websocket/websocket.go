@@ -0,0 +1,186 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+// Package websocket implements the server side of the WebSocket protocol
+// on top of a response. See RFC 6455.
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hslam/response"
+)
+
+const (
+	secWebSocketKey      = "Sec-WebSocket-Key"
+	secWebSocketVersion  = "Sec-WebSocket-Version"
+	secWebSocketAccept   = "Sec-WebSocket-Accept"
+	secWebSocketProtocol = "Sec-WebSocket-Protocol"
+	websocketVersion     = "13"
+	websocketProtocol    = "websocket"
+	acceptGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// defaultReadLimit is the maximum size of a message read when the
+// options don't set one.
+const defaultReadLimit = 16 << 20
+
+// Options configures Upgrade. The zero value accepts same-origin
+// requests without a subprotocol.
+type Options struct {
+	// Subprotocols lists the subprotocols the server supports, in order
+	// of preference. The first one the client requests is selected.
+	Subprotocols []string
+
+	// CheckOrigin returns whether the request's origin is allowed. If
+	// nil, requests with an Origin header whose host is not the host of
+	// the request are refused.
+	CheckOrigin func(r *http.Request) bool
+
+	// ReadLimit is the maximum size of a message read. A larger message
+	// closes the connection with CloseMessageTooBig. Zero means 16MB.
+	ReadLimit int64
+
+	// Header is added to the header of the 101 Switching Protocols
+	// response, e.g. to set cookies.
+	Header http.Header
+}
+
+// HandshakeError is returned by Upgrade when the request is not a valid
+// WebSocket handshake. The response has been written already.
+type HandshakeError struct {
+	// Status is the status code of the response.
+	Status int
+	// Reason describes what is wrong with the request.
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return "websocket: " + e.Reason
+}
+
+// Upgrade validates the WebSocket handshake of the request, switches the
+// connection to WebSocket with Response.Upgrade, and returns the WebSocket
+// connection, which reads and writes through the response's pooled
+// bufio.ReadWriter.
+//
+// If the handshake is not valid, Upgrade replies with an error status and
+// returns a *HandshakeError. A nil opts is the same as the zero Options.
+func Upgrade(w *response.Response, r *http.Request, opts *Options) (*Conn, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := checkHandshake(r, opts); err != nil {
+		if err.Status == http.StatusUpgradeRequired {
+			w.Header().Set(secWebSocketVersion, websocketVersion)
+		}
+		http.Error(w, err.Reason, err.Status)
+		return nil, err
+	}
+	header := make(http.Header, len(opts.Header)+2)
+	for key, values := range opts.Header {
+		header[key] = values
+	}
+	header.Set(secWebSocketAccept, acceptKey(r.Header.Get(secWebSocketKey)))
+	subprotocol := selectSubprotocol(r, opts.Subprotocols)
+	if subprotocol != "" {
+		header.Set(secWebSocketProtocol, subprotocol)
+	}
+	conn, rw, err := w.Upgrade(websocketProtocol, header)
+	if err != nil {
+		return nil, err
+	}
+	// The connection outlives the deadlines of the response.
+	conn.SetDeadline(time.Time{})
+	readLimit := opts.ReadLimit
+	if readLimit <= 0 {
+		readLimit = defaultReadLimit
+	}
+	return newConn(conn, rw, subprotocol, readLimit), nil
+}
+
+// checkHandshake checks the opening handshake of the client. See RFC 6455,
+// section 4.2.1.
+func checkHandshake(r *http.Request, opts *Options) *HandshakeError {
+	if r.Method != http.MethodGet {
+		return &HandshakeError{http.StatusMethodNotAllowed, "request method is not GET"}
+	}
+	if !r.ProtoAtLeast(1, 1) {
+		return &HandshakeError{http.StatusBadRequest, "request protocol is not HTTP/1.1"}
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") {
+		return &HandshakeError{http.StatusBadRequest, "'upgrade' token not found in 'Connection' header"}
+	}
+	if !headerHasToken(r.Header, "Upgrade", websocketProtocol) {
+		return &HandshakeError{http.StatusBadRequest, "'websocket' token not found in 'Upgrade' header"}
+	}
+	if r.Header.Get(secWebSocketVersion) != websocketVersion {
+		return &HandshakeError{http.StatusUpgradeRequired, "unsupported version"}
+	}
+	if key, err := base64.StdEncoding.DecodeString(r.Header.Get(secWebSocketKey)); err != nil || len(key) != 16 {
+		return &HandshakeError{http.StatusBadRequest, "'Sec-WebSocket-Key' header is not valid"}
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return &HandshakeError{http.StatusForbidden, "origin not allowed"}
+	}
+	return nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value of the key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// sameOrigin reports whether the request has no Origin header, or one
+// whose host is the host of the request.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// selectSubprotocol returns the first of the supported subprotocols the
+// client requests, or an empty string. Subprotocols are case-sensitive.
+func selectSubprotocol(r *http.Request, supported []string) string {
+	for _, protocol := range supported {
+		for _, v := range r.Header.Values(secWebSocketProtocol) {
+			for _, s := range strings.Split(v, ",") {
+				if strings.TrimSpace(s) == protocol {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// headerHasToken reports whether a comma-separated element of the
+// values of the key is the token, ASCII case-insensitive.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
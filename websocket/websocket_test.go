@@ -0,0 +1,226 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hslam/response"
+)
+
+const handshake = "GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+
+// testUpgrade serves the connection with a handler upgrading it with the
+// options, and sends the raw handshake from the client. It returns the
+// client's reader, the handshake response and the channel of the error
+// returned by serve.
+func testUpgrade(opts *Options, raw string, serve func(*Conn) error, t *testing.T) (net.Conn, *bufio.Reader, *http.Response, chan error) {
+	errc := make(chan error, 1)
+	srv := &response.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w.(*response.Response), r, opts)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		errc <- serve(conn)
+	})}
+	client, conn := net.Pipe()
+	go srv.ServeConn(conn)
+	go io.WriteString(client, raw)
+	br := bufio.NewReader(client)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, br, res, errc
+}
+
+var testMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// writeClientFrame writes a masked frame.
+func writeClientFrame(w io.Writer, fin bool, opcode byte, payload []byte) {
+	b := []byte{opcode, maskBit}
+	if fin {
+		b[0] |= finBit
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		b[1] |= byte(n)
+	default:
+		b[1] |= 126
+		b = append(b, byte(n>>8), byte(n))
+	}
+	b = append(b, testMask[:]...)
+	for i, c := range payload {
+		b = append(b, c^testMask[i&3])
+	}
+	w.Write(b)
+}
+
+// readServerFrame reads an unmasked frame shorter than 64KB.
+func readServerFrame(br *bufio.Reader, t *testing.T) (opcode byte, payload []byte) {
+	var b [4]byte
+	if _, err := io.ReadFull(br, b[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if b[0]&finBit == 0 || b[1]&maskBit != 0 {
+		t.Fatalf("unexpected frame header %x", b[:2])
+	}
+	n := int(b[1])
+	if n == 126 {
+		io.ReadFull(br, b[2:4])
+		n = int(binary.BigEndian.Uint16(b[2:4]))
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return b[0] & 0xf, payload
+}
+
+func TestAcceptKey(t *testing.T) {
+	// The example of RFC 6455, section 1.3.
+	if key := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got %q", key)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	opts := &Options{Subprotocols: []string{"chat"}, Header: http.Header{"Set-Cookie": {"id=1"}}}
+	raw := handshake + "Sec-WebSocket-Protocol: superchat, chat\r\nOrigin: http://localhost\r\n\r\n"
+	var pong string
+	client, br, res, errc := testUpgrade(opts, raw, func(conn *Conn) error {
+		conn.SetPongHandler(func(p []byte) { pong = string(p) })
+		if conn.Subprotocol() != "chat" {
+			t.Errorf("got subprotocol %q", conn.Subprotocol())
+		}
+		for {
+			typ, p, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+			if err := conn.WriteMessage(typ, p); err != nil {
+				return err
+			}
+		}
+	}, t)
+	defer client.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d", res.StatusCode)
+	}
+	for key, want := range map[string]string{
+		"Upgrade":                "websocket",
+		"Connection":             "Upgrade",
+		"Sec-WebSocket-Accept":   "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+		"Sec-WebSocket-Protocol": "chat",
+		"Set-Cookie":             "id=1",
+		"Content-Length":         "",
+		"Transfer-Encoding":      "",
+	} {
+		if got := res.Header.Get(key); got != want {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+
+	// A fragmented message with a ping between its fragments.
+	go func() {
+		writeClientFrame(client, false, opText, []byte("Hello "))
+		writeClientFrame(client, true, opPing, []byte("ping"))
+		writeClientFrame(client, true, opContinuation, []byte("World"))
+	}()
+	if op, p := readServerFrame(br, t); op != opPong || string(p) != "ping" {
+		t.Errorf("got frame %x %q, want a pong", op, p)
+	}
+	if op, p := readServerFrame(br, t); op != opText || string(p) != "Hello World" {
+		t.Errorf("got frame %x %q", op, p)
+	}
+	big := strings.Repeat("a", 300)
+	go func() {
+		writeClientFrame(client, true, opPong, []byte("pong"))
+		writeClientFrame(client, true, opBinary, []byte(big))
+	}()
+	if op, p := readServerFrame(br, t); op != opBinary || string(p) != big {
+		t.Errorf("got frame %x of %d bytes", op, len(p))
+	}
+	if pong != "pong" {
+		t.Errorf("pong handler got %q", pong)
+	}
+
+	go writeClientFrame(client, true, opClose, closePayload(CloseGoingAway, "bye"))
+	if op, p := readServerFrame(br, t); op != opClose || binary.BigEndian.Uint16(p) != CloseGoingAway {
+		t.Errorf("got frame %x %q, want the close echoed", op, p)
+	}
+	err := <-errc
+	if e, ok := err.(*CloseError); !ok || e.Code != CloseGoingAway || e.Text != "bye" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestUpgradeHandshakeError(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"method", strings.Replace(handshake, "GET", "POST", 1) + "Content-Length: 0\r\n\r\n", http.StatusMethodNotAllowed},
+		{"upgrade", strings.Replace(handshake, "Upgrade: websocket", "Upgrade: h2c", 1) + "\r\n", http.StatusBadRequest},
+		{"connection", strings.Replace(handshake, "Connection: Upgrade", "Connection: keep-alive", 1) + "\r\n", http.StatusBadRequest},
+		{"version", strings.Replace(handshake, "Version: 13", "Version: 8", 1) + "\r\n", http.StatusUpgradeRequired},
+		{"key", strings.Replace(handshake, "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1) + "\r\n", http.StatusBadRequest},
+		{"origin", handshake + "Origin: http://example.com\r\n\r\n", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		client, _, res, errc := testUpgrade(nil, test.raw, func(conn *Conn) error { return nil }, t)
+		client.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, res.StatusCode, test.status)
+		}
+		if test.status == http.StatusUpgradeRequired && res.Header.Get("Sec-WebSocket-Version") != "13" {
+			t.Errorf("%s: got header %v", test.name, res.Header)
+		}
+		if e, ok := (<-errc).(*HandshakeError); !ok || e.Status != test.status {
+			t.Errorf("%s: got %v", test.name, e)
+		}
+	}
+}
+
+func TestReadMessageClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame func(w io.Writer)
+		code  int
+	}{
+		{"unmasked", func(w io.Writer) { w.Write([]byte{finBit | opText, 1, 'a'}) }, CloseProtocolError},
+		{"reserved", func(w io.Writer) { writeClientFrame(w, true, opText|0x40, []byte("a")) }, CloseProtocolError},
+		{"opcode", func(w io.Writer) { writeClientFrame(w, true, 0x3, []byte("a")) }, CloseProtocolError},
+		{"continuation", func(w io.Writer) { writeClientFrame(w, true, opContinuation, []byte("a")) }, CloseProtocolError},
+		{"fragmented ping", func(w io.Writer) { writeClientFrame(w, false, opPing, nil) }, CloseProtocolError},
+		{"close code", func(w io.Writer) { writeClientFrame(w, true, opClose, closePayload(1005, "")) }, CloseProtocolError},
+		{"too big", func(w io.Writer) { writeClientFrame(w, true, opBinary, []byte("Hello World")) }, CloseMessageTooBig},
+		{"utf-8", func(w io.Writer) { writeClientFrame(w, true, opText, []byte{0xff, 0xfe}) }, CloseInvalidFramePayloadData},
+	}
+	for _, test := range tests {
+		client, br, _, errc := testUpgrade(&Options{ReadLimit: 8}, handshake+"\r\n", func(conn *Conn) error {
+			_, _, err := conn.ReadMessage()
+			return err
+		}, t)
+		go test.frame(client)
+		op, p := readServerFrame(br, t)
+		if op != opClose || len(p) < 2 || int(binary.BigEndian.Uint16(p)) != test.code {
+			t.Errorf("%s: got frame %x %q, want close %d", test.name, op, p, test.code)
+		}
+		if e, ok := (<-errc).(*CloseError); !ok || e.Code != test.code {
+			t.Errorf("%s: got %v", test.name, e)
+		}
+		client.Close()
+	}
+}